@@ -0,0 +1,43 @@
+package client
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff configures delays between reconnect attempts. The delay starts
+// at Initial and is multiplied by Multiplier after every failed attempt,
+// up to Max. Jitter is the fraction of the delay that is randomized, so
+// clients disconnected at the same time don't reconnect all at once.
+// Zero fields take default values, so jitter can't be turned off.
+type Backoff struct {
+	Initial     time.Duration
+	Max         time.Duration
+	Multiplier  float64
+	Jitter      float64
+	MaxAttempts int // consecutive failed attempts before giving up, 0 for unlimited
+}
+
+func (b Backoff) withDefaults() Backoff {
+	if b.Initial <= 0 {
+		b.Initial = time.Second
+	}
+	if b.Max <= 0 {
+		b.Max = time.Minute
+	}
+	if b.Multiplier < 1 {
+		b.Multiplier = 2
+	}
+	if b.Jitter <= 0 || b.Jitter > 1 {
+		b.Jitter = 0.2
+	}
+	return b
+}
+
+// delay returns how long to wait before the given attempt, starting at 0.
+func (b Backoff) delay(attempt int) time.Duration {
+	d := math.Min(float64(b.Initial)*math.Pow(b.Multiplier, float64(attempt)), float64(b.Max))
+	d -= d * b.Jitter * rand.Float64()
+	return time.Duration(d)
+}
@@ -1,11 +1,14 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -14,99 +17,443 @@ import (
 // BoreClient defines bore client.
 type BoreClient struct {
 	config         Config
-	sshConfig      *ssh.ClientConfig
-	sshClient      *ssh.Client
 	LocalEndpoint  endpoint // local service to be forwarded
 	ServerEndpoint endpoint // remote SSH server
 	RemoteEndpoint endpoint // remote forwarding port (on remote SSH server network)
-	id             string
+	tunnels        []tunnel
+	serverVersion  string
+	inspector      *inspector // captures HTTP requests, if enabled or written to a HAR file
+}
+
+// tunnel is a single local endpoint forwarded from the remote listener.
+type tunnel struct {
+	name        string
+	id          string
+	udp         bool
+	domains     []string
+	auth        string // user:password
+	bearer      string
+	oidc        *OIDCAccess
+	allowIPs    []string
+	denyIPs     []string
+	local       endpoint
+	remote      endpoint
+	resumeToken string        // token to get the same ID and port back after reconnect
+	assignedID  string        // ID the tunnel is served under, if known
+	port        int           // port the server listens on
+	udpTimeout  time.Duration // how long UDP peers are kept without traffic
+	info        *tunnelInfoPayload
+}
+
+// conn is a single SSH connection to the server with its listeners.
+type conn struct {
+	sshClient *ssh.Client
+	listeners []net.Listener        // nil for UDP tunnels
+	udpChans  <-chan ssh.NewChannel // forwarded-udp channels, if any tunnel forwards UDP
+}
+
+func (cn *conn) Close() error {
+	for _, listener := range cn.listeners {
+		if listener != nil {
+			listener.Close()
+		}
+	}
+	return cn.sshClient.Close()
 }
 
 type idRequestPayload struct {
 	ID string
 }
 
+type tcpIPForwardPayload struct {
+	Addr string
+	Port uint32
+}
+
+type resumeRequestPayload struct {
+	Token string
+}
+
+type resumeReplyPayload struct {
+	ID   string
+	Port uint32
+}
+
+type resumeTokenReplyPayload struct {
+	Token string
+}
+
+type tunnelInfoPayload struct {
+	ID       string
+	HTTPURL  string
+	HTTPSURL string
+	TCPAddr  string
+	Version  string
+}
+
+type setAuthPayload struct {
+	Username string
+	Password string
+	Bearer   string
+}
+
+type setOIDCPayload struct {
+	Domains string
+	Groups  string
+}
+
+type setIPFilterPayload struct {
+	Allow string
+	Deny  string
+}
+
+type addDomainPayload struct {
+	Addr   string
+	Port   uint32
+	Domain string
+}
+
+type requestErrorPayload struct {
+	Message string
+}
+
 // NewBoreClient returns new instance of BoreClient.
 func NewBoreClient(config Config) BoreClient {
-	return BoreClient{
+	if config.KnownHostsFile == "" {
+		config.KnownHostsFile = defaultKnownHostsFile()
+	}
+
+	var tunnels []tunnel
+	for _, t := range config.tunnels() {
+		tunnels = append(tunnels, tunnel{
+			name:     t.Name,
+			id:       t.ID,
+			udp:      t.UDP,
+			domains:  t.Domains,
+			auth:     t.Auth,
+			bearer:   t.Bearer,
+			oidc:     t.OIDC,
+			allowIPs: t.AllowIPs,
+			denyIPs:  t.DenyIPs,
+			local:    endpoint{t.LocalServer, t.LocalPort},
+			remote:   endpoint{"0.0.0.0", t.BindPort},
+		})
+	}
+
+	c := BoreClient{
 		config:         config,
-		LocalEndpoint:  endpoint{config.LocalServer, config.LocalPort},
+		LocalEndpoint:  tunnels[0].local,
 		ServerEndpoint: endpoint{config.RemoteServer, config.RemotePort},
-		RemoteEndpoint: endpoint{"0.0.0.0", config.BindPort},
-		sshConfig:      &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()},
-		id:             config.ID,
+		RemoteEndpoint: tunnels[0].remote,
+		tunnels:        tunnels,
+	}
+	if config.Inspect != "" || config.HAR != "" {
+		c.inspector = newInspector(config)
 	}
+	return c
 }
 
-// Run starts the client.
+// Run starts the client and blocks until the connection fails or the
+// process is interrupted. Server messages are written to os.Stdout
+// unless Config.Output is set. Programs embedding the client should
+// use Start instead.
 func (c *BoreClient) Run() error {
-	// Healthcheck
-	local, err := net.Dial("tcp", c.LocalEndpoint.String())
-	if err != nil {
-		return err
-	}
-	_ = local.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-	ch := make(chan os.Signal, 1)
-	errch := make(chan error)
-	signal.Notify(ch, os.Interrupt)
+	if c.config.Output == nil {
+		c.config.Output = os.Stdout
+	}
 
-	client, err := ssh.Dial("tcp", c.ServerEndpoint.String(), c.sshConfig)
+	t, err := c.Start(ctx)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
 		return err
 	}
-	c.sshClient = client
 
-	done := make(chan struct{})
-	if c.config.KeepAlive {
-		go keepAliveTicker(c.sshClient, done)
+	if url := t.Info().Inspector; url != "" {
+		log.Printf("inspecting requests at %s", url)
 	}
+	if c.config.HAR != "" {
+		log.Printf("writing HTTP requests to %s", c.config.HAR)
+	}
+
+	go func() {
+		for e := range t.Events() {
+			if e.Type == EventReconnecting || e.Type == EventHostKeyAdded || e.Type == EventHARFailed {
+				log.Println(e)
+			}
+		}
+	}()
+
+	return t.Wait()
+}
 
-	if c.id != "" {
-		_, _, err = c.sshClient.SendRequest("set-id", true, ssh.Marshal(&idRequestPayload{c.id}))
+// connect dials the server and opens all tunnels.
+func (c *BoreClient) connect(ctx context.Context, emit func(Event)) (*conn, error) {
+	var dialer net.Dialer
+
+	// Healthcheck, UDP has no connection to check.
+	for _, t := range c.tunnels {
+		if t.udp {
+			continue
+		}
+		local, err := dialer.DialContext(ctx, "tcp", t.local.String())
 		if err != nil {
-			return err
+			return nil, err
 		}
+		_ = local.Close()
 	}
 
-	if err := c.writeStdout(); err != nil {
-		return err
+	var auth []ssh.AuthMethod
+	if c.config.PrivateKey != "" {
+		signer, err := loadPrivateKey(c.config.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if c.config.Token != "" {
+		auth = append(auth, ssh.Password(c.config.Token), ssh.KeyboardInteractive(c.tokenChallenge))
+	}
+	sshConfig := &ssh.ClientConfig{
+		User:            c.user(),
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback(c.config, emit),
 	}
 
-	listener, err := c.sshClient.Listen("tcp", c.RemoteEndpoint.String())
+	addr := c.ServerEndpoint.String()
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer listener.Close()
+	stop := context.AfterFunc(ctx, func() { netConn.Close() })
+	defer stop()
 
-	go func() {
-		for {
-			local, err := net.Dial("tcp", c.LocalEndpoint.String())
-			if err != nil {
-				errch <- err
-				return
-			}
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, addr, sshConfig)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	cn := &conn{sshClient: ssh.NewClient(sshConn, chans, reqs)}
 
-			client, err := listener.Accept()
-			if err != nil {
+	if err := c.writeOutput(cn.sshClient); err != nil {
+		cn.Close()
+		return nil, err
+	}
+
+	for _, t := range c.tunnels {
+		if t.udp {
+			cn.udpChans = cn.sshClient.HandleChannelOpen("forwarded-udp")
+			break
+		}
+	}
+
+	for i := range c.tunnels {
+		listener, err := c.listen(cn.sshClient, &c.tunnels[i])
+		if err != nil {
+			cn.Close()
+			return nil, err
+		}
+		cn.listeners = append(cn.listeners, listener)
+	}
+
+	return cn, nil
+}
+
+// serve forwards connections accepted on the tunnels to the local
+// endpoints until ctx is cancelled or the connection fails.
+func (c *BoreClient) serve(ctx context.Context, cn *conn) error {
+	errch := make(chan error, len(cn.listeners)+1)
+	done := make(chan struct{})
+	defer close(done)
+
+	if c.config.KeepAlive {
+		go func() {
+			if err := keepAliveTicker(cn.sshClient, done); err != nil {
 				errch <- err
-				return
 			}
+		}()
+	}
+
+	if cn.udpChans != nil {
+		go serveUDP(cn.udpChans, append([]tunnel(nil), c.tunnels...))
+	}
 
-			go handleClient(client, local)
+	for i, listener := range cn.listeners {
+		if listener == nil {
+			continue
 		}
-	}()
+		go func(t tunnel, listener net.Listener) {
+			for {
+				client, err := listener.Accept()
+				if err != nil {
+					errch <- err
+					return
+				}
+
+				local, err := net.Dial("tcp", t.local.String())
+				if err != nil {
+					client.Close()
+					errch <- err
+					return
+				}
+
+				if c.inspector != nil {
+					go c.inspector.handle(t, client, local)
+				} else {
+					go handleClient(client, local)
+				}
+			}
+		}(c.tunnels[i], listener)
+	}
 
 	select {
-	case <-ch:
+	case <-ctx.Done():
 		return nil
 	case err := <-errch:
 		return err
 	}
 }
 
-func (c *BoreClient) writeStdout() error {
-	session, err := c.sshClient.NewSession()
+// listen requests the tunnel ID, if any, and opens the remote listener.
+// The server binds the ID to the next tcpip-forward request, so the two
+// requests must not be interleaved with other tunnels. UDP tunnels have
+// no listener, their datagrams arrive on forwarded-udp channels.
+func (c *BoreClient) listen(sshClient *ssh.Client, t *tunnel) (net.Listener, error) {
+	remote := t.remote
+	t.assignedID = ""
+	t.info = nil
+
+	config := TunnelConfig{UDP: t.udp, Auth: t.auth, Bearer: t.bearer, OIDC: t.oidc, Domains: t.domains}
+	if err := config.validateUDP(); err != nil {
+		return nil, err
+	}
+
+	if t.resumeToken != "" {
+		ok, reply, err := sshClient.SendRequest("resume", true, ssh.Marshal(&resumeRequestPayload{t.resumeToken}))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// Expired or unknown, the tunnel gets new ID and port. A
+			// token used up here is replaced once the tunnel is open.
+			t.resumeToken = ""
+		}
+
+		var payload resumeReplyPayload
+		if ok && ssh.Unmarshal(reply, &payload) == nil {
+			remote.port = int(payload.Port)
+			t.assignedID = payload.ID
+		}
+	}
+
+	if t.assignedID == "" && t.id != "" {
+		ok, reply, err := sshClient.SendRequest("set-id", true, ssh.Marshal(&idRequestPayload{t.id}))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, requestError("set-id", reply)
+		}
+		t.assignedID = t.id
+	}
+
+	// Servers not supporting set-auth, set-oidc or set-ip-filter reject
+	// them, so the tunnel is never opened unprotected.
+	if t.auth != "" || t.bearer != "" {
+		user, pass, _ := strings.Cut(t.auth, ":")
+		ok, reply, err := sshClient.SendRequest("set-auth", true, ssh.Marshal(&setAuthPayload{user, pass, t.bearer}))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, requestError("set-auth", reply)
+		}
+	}
+
+	if t.oidc != nil {
+		payload := setOIDCPayload{strings.Join(t.oidc.Domains, ","), strings.Join(t.oidc.Groups, ",")}
+		ok, reply, err := sshClient.SendRequest("set-oidc", true, ssh.Marshal(&payload))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, requestError("set-oidc", reply)
+		}
+	}
+
+	if len(t.allowIPs) > 0 || len(t.denyIPs) > 0 {
+		payload := setIPFilterPayload{strings.Join(t.allowIPs, ","), strings.Join(t.denyIPs, ",")}
+		ok, reply, err := sshClient.SendRequest("set-ip-filter", true, ssh.Marshal(&payload))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, requestError("set-ip-filter", reply)
+		}
+	}
+
+	var listener net.Listener
+	if t.udp {
+		port, timeout, err := listenUDP(sshClient, remote)
+		if err != nil {
+			return nil, err
+		}
+		t.port = port
+		t.udpTimeout = timeout
+	} else {
+		var err error
+		listener, err = sshClient.Listen("tcp", remote.String())
+		if err != nil {
+			return nil, err
+		}
+		t.port = listener.Addr().(*net.TCPAddr).Port
+	}
+
+	for _, domain := range t.domains {
+		ok, reply, err := sshClient.SendRequest("add-domain", true, ssh.Marshal(&addDomainPayload{remote.host, uint32(t.port), domain}))
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		if !ok {
+			listener.Close()
+			return nil, requestError("add-domain", reply)
+		}
+	}
+
+	// Servers not supporting resume reject the request, in which case
+	// the tunnel just gets new ID and port after reconnect.
+	ok, reply, err := sshClient.SendRequest("resume-token", true, ssh.Marshal(&tcpIPForwardPayload{remote.host, uint32(t.port)}))
+	if err == nil && ok {
+		var payload resumeTokenReplyPayload
+		if ssh.Unmarshal(reply, &payload) == nil {
+			t.resumeToken = payload.Token
+		}
+	}
+
+	// Older servers don't answer tunnel-info, the URLs are then derived
+	// from the requested ID and server address.
+	ok, reply, err = sshClient.SendRequest("tunnel-info", true, ssh.Marshal(&tcpIPForwardPayload{remote.host, uint32(t.port)}))
+	if err == nil && ok {
+		var payload tunnelInfoPayload
+		if ssh.Unmarshal(reply, &payload) == nil {
+			t.info = &payload
+			t.assignedID = payload.ID
+			c.serverVersion = payload.Version
+		}
+	}
+
+	return listener, nil
+}
+
+// writeOutput copies messages the server writes to the session into
+// Config.Output.
+func (c *BoreClient) writeOutput(sshClient *ssh.Client) error {
+	session, err := sshClient.NewSession()
 	if err != nil {
 		return err
 	}
@@ -115,14 +462,78 @@ func (c *BoreClient) writeStdout() error {
 		return err
 	}
 
+	out := c.config.Output
+	if out == nil {
+		out = io.Discard
+	}
+
 	go func() {
 		defer session.Close()
-		io.Copy(os.Stdout, stdout)
+		io.Copy(out, stdout)
 	}()
 
 	return nil
 }
 
+func (c *BoreClient) tokenChallenge(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	answers := make([]string, len(questions))
+	for i := range questions {
+		answers[i] = c.config.Token
+	}
+	return answers, nil
+}
+
+// requestError builds an error from a rejected global request reply.
+func requestError(reqType string, reply []byte) error {
+	var payload requestErrorPayload
+	if err := ssh.Unmarshal(reply, &payload); err != nil || payload.Message == "" {
+		return fmt.Errorf("%s request rejected by server", reqType)
+	}
+	return fmt.Errorf("%s request rejected by server: %s", reqType, payload.Message)
+}
+
+// user returns the SSH user, which is the first ID claimed. Servers
+// accept certificates only for a user among their principals.
+func (c *BoreClient) user() string {
+	for _, t := range c.tunnels {
+		if t.id != "" {
+			return t.id
+		}
+	}
+	return ""
+}
+
+// loadPrivateKey reads the private key from path. If a certificate
+// named like OpenSSH does (id_ed25519-cert.pub) exists next to the key,
+// the returned signer authenticates with the certificate.
+func loadPrivateKey(path string) (ssh.Signer, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path + "-cert.pub")
+	if os.IsNotExist(err) {
+		return signer, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s-cert.pub is not a certificate", path)
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
+
 type endpoint struct {
 	host string
 	port int
@@ -135,7 +546,7 @@ func (e *endpoint) String() string {
 func handleClient(client net.Conn, remote net.Conn) {
 	defer client.Close()
 	defer remote.Close()
-	done := make(chan struct{})
+	done := make(chan struct{}, 2)
 
 	go func() {
 		io.Copy(client, remote)
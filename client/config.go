@@ -1,6 +1,13 @@
 package client
 
-// Config holds configuration data.
+import (
+	"fmt"
+	"io"
+)
+
+// Config holds configuration data. LocalServer, LocalPort, BindPort, ID,
+// UDP, Domains, Auth, Bearer, OIDC, AllowIPs and DenyIPs describe the
+// tunnel to open unless Tunnels is set.
 type Config struct {
 	RemoteServer string
 	RemotePort   int
@@ -8,5 +15,79 @@ type Config struct {
 	LocalPort    int
 	BindPort     int
 	ID           string
+	UDP          bool
+	Domains      []string
+	Auth         string
+	Bearer       string
+	OIDC         *OIDCAccess
+	AllowIPs     []string
+	DenyIPs      []string
 	KeepAlive    bool
+	PrivateKey   string // path to private key used for public-key auth
+	Token        string // API token used for password auth
+
+	Reconnect          bool
+	Backoff            Backoff
+	Output             io.Writer // receives messages from the server, discarded if nil
+	KnownHostsFile     string    // defaults to ~/.bore/known_hosts
+	HostKeyFingerprint string    // pinned SHA256 server host key fingerprint
+	Inspect            string    // address of the local request inspector UI, disabled if empty
+	InspectLimit       int       // number of requests the inspector keeps, 100 if zero
+	HAR                string    // path of HAR file HTTP requests are written to as they complete, disabled if empty
+	HARRedact          []string  // headers with values redacted in the HAR file, har.DefaultRedact if nil
+
+	Tunnels []TunnelConfig
+}
+
+// TunnelConfig describes a single local service exposed through the
+// bore server.
+type TunnelConfig struct {
+	Name        string
+	LocalServer string
+	LocalPort   int
+	BindPort    int
+	ID          string
+	UDP         bool     // forward UDP datagrams instead of TCP connections
+	Domains     []string // custom domains routed to the tunnel
+	Auth        string   // user:password required to access the tunnel over HTTP
+	Bearer      string   // bearer token required to access the tunnel over HTTP
+	OIDC        *OIDCAccess
+	AllowIPs    []string // CIDRs allowed to reach the tunnel, all if empty
+	DenyIPs     []string // CIDRs refused access to the tunnel
+}
+
+// OIDCAccess requires visitors to log in with the server's OIDC
+// provider. If Domains or Groups are set, only users with email in one
+// of the domains or in one of the groups are let in.
+type OIDCAccess struct {
+	Domains []string
+	Groups  []string
+}
+
+// validateUDP checks that a UDP tunnel doesn't use options that only
+// apply to HTTP.
+func (t TunnelConfig) validateUDP() error {
+	if t.UDP && (t.Auth != "" || t.Bearer != "" || t.OIDC != nil || len(t.Domains) > 0) {
+		return fmt.Errorf("UDP tunnels can't use auth, bearer, OIDC or custom domains")
+	}
+	return nil
+}
+
+func (c Config) tunnels() []TunnelConfig {
+	if len(c.Tunnels) > 0 {
+		return c.Tunnels
+	}
+	return []TunnelConfig{{
+		LocalServer: c.LocalServer,
+		LocalPort:   c.LocalPort,
+		BindPort:    c.BindPort,
+		ID:          c.ID,
+		UDP:         c.UDP,
+		Domains:     c.Domains,
+		Auth:        c.Auth,
+		Bearer:      c.Bearer,
+		OIDC:        c.OIDC,
+		AllowIPs:    c.AllowIPs,
+		DenyIPs:     c.DenyIPs,
+	}}
 }
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/jkuri/bore/pkg/fs"
+	"github.com/jkuri/bore/pkg/har"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+)
+
+// fileConfig is the structure of bore.yaml client config file.
+type fileConfig struct {
+	Server struct {
+		Host               string
+		Port               int
+		KnownHosts         string
+		HostKeyFingerprint string
+	}
+	Auth struct {
+		PrivateKey string
+		Token      string
+	}
+	KeepAlive bool
+	Inspect   struct {
+		Addr  string
+		Limit int
+	}
+	HAR struct {
+		File   string
+		Redact []string // redacted headers, "none" disables redaction
+	}
+	Reconnect struct {
+		Enabled bool
+		Backoff `mapstructure:",squash"`
+	}
+	Tunnels []TunnelConfig
+}
+
+// NewConfig returns viper config read from configPath. If configPath is
+// empty, bore.yaml is looked up in the current directory and in ~/.bore.
+// If no config file is found only defaults are set.
+func NewConfig(configPath string) (*viper.Viper, error) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+
+	v.SetDefault("server.host", "bore.digital")
+	v.SetDefault("server.port", 2200)
+	v.SetDefault("keepalive", true)
+
+	v.SetEnvPrefix("bore")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+
+	if configPath != "" {
+		path, err := homedir.Expand(configPath)
+		if err != nil {
+			return nil, err
+		}
+		if !fs.Exists(path) {
+			return nil, fmt.Errorf("config file %s not found", path)
+		}
+		v.SetConfigFile(path)
+		return v, v.ReadInConfig()
+	}
+
+	candidates := []string{"bore.yaml"}
+	if home, err := fs.GetHomeDir(); err == nil {
+		candidates = append(candidates, filepath.Join(home, ".bore", "bore.yaml"))
+	}
+	for _, path := range candidates {
+		if fs.Exists(path) {
+			v.SetConfigFile(path)
+			return v, v.ReadInConfig()
+		}
+	}
+	return v, nil
+}
+
+// NewConfigFromViper returns client config. If names are given, only
+// tunnels with those names are included, in the order requested.
+func NewConfigFromViper(v *viper.Viper, names ...string) (Config, error) {
+	var fc fileConfig
+	if err := v.Unmarshal(&fc); err != nil {
+		return Config{}, err
+	}
+
+	privateKey, err := homedir.Expand(fc.Auth.PrivateKey)
+	if err != nil {
+		return Config{}, err
+	}
+	knownHosts, err := homedir.Expand(fc.Server.KnownHosts)
+	if err != nil {
+		return Config{}, err
+	}
+
+	config := Config{
+		RemoteServer:       fc.Server.Host,
+		RemotePort:         fc.Server.Port,
+		LocalServer:        "localhost",
+		LocalPort:          80,
+		KeepAlive:          fc.KeepAlive,
+		Reconnect:          fc.Reconnect.Enabled,
+		Backoff:            fc.Reconnect.Backoff,
+		PrivateKey:         privateKey,
+		Token:              fc.Auth.Token,
+		KnownHostsFile:     knownHosts,
+		HostKeyFingerprint: fc.Server.HostKeyFingerprint,
+		Inspect:            fc.Inspect.Addr,
+		InspectLimit:       fc.Inspect.Limit,
+		HAR:                fc.HAR.File,
+	}
+	if fc.HAR.Redact != nil {
+		config.HARRedact = har.ParseRedact(strings.Join(fc.HAR.Redact, ","))
+	}
+
+	byName := make(map[string]TunnelConfig)
+	for i, t := range fc.Tunnels {
+		if t.Name == "" {
+			return Config{}, fmt.Errorf("tunnel #%d has no name", i+1)
+		}
+		if _, ok := byName[t.Name]; ok {
+			return Config{}, fmt.Errorf("duplicate tunnel name %q", t.Name)
+		}
+		if t.LocalServer == "" {
+			t.LocalServer = "localhost"
+		}
+		if t.Auth != "" && !strings.Contains(t.Auth, ":") {
+			return Config{}, fmt.Errorf("tunnel %q: auth must be in user:password format", t.Name)
+		}
+		if err := t.validateUDP(); err != nil {
+			return Config{}, fmt.Errorf("tunnel %q: %v", t.Name, err)
+		}
+		byName[t.Name] = t
+		if len(names) == 0 {
+			config.Tunnels = append(config.Tunnels, t)
+		}
+	}
+
+	for _, name := range names {
+		t, ok := byName[name]
+		if !ok {
+			return Config{}, fmt.Errorf("tunnel %q not found in config file", name)
+		}
+		config.Tunnels = append(config.Tunnels, t)
+	}
+
+	return config, nil
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/jkuri/bore/pkg/fs"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// defaultKnownHostsFile returns path to ~/.bore/known_hosts.
+func defaultKnownHostsFile() string {
+	home, err := fs.GetHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".bore", "known_hosts")
+}
+
+// hostKeyCallback returns callback that checks the server host key
+// against the pinned fingerprint if one is configured, otherwise against
+// the known_hosts file. Keys of hosts seen for the first time are
+// trusted and recorded.
+func hostKeyCallback(config Config, emit func(Event)) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return verifyHostKey(config, emit, hostname, remote, key)
+	}
+}
+
+func verifyHostKey(config Config, emit func(Event), hostname string, remote net.Addr, key ssh.PublicKey) error {
+	fingerprint := ssh.FingerprintSHA256(key)
+
+	if config.HostKeyFingerprint != "" {
+		if fingerprint != config.HostKeyFingerprint {
+			return fmt.Errorf("host key mismatch for %s: expected %s, got %s", hostname, config.HostKeyFingerprint, fingerprint)
+		}
+		return nil
+	}
+
+	path := config.KnownHostsFile
+	if path == "" {
+		return fmt.Errorf("no known_hosts file configured to verify host key %s of %s", fingerprint, hostname)
+	}
+	if !fs.Exists(path) {
+		return addKnownHost(path, emit, hostname, remote, key)
+	}
+
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return err
+	}
+	err = callback(hostname, remote, key)
+
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) {
+		if len(keyErr.Want) == 0 {
+			return addKnownHost(path, emit, hostname, remote, key)
+		}
+		want := keyErr.Want[0]
+		return fmt.Errorf(
+			"host key mismatch for %s: expected %s (%s:%d), got %s. If the server key was changed on purpose, remove the old entry from %s",
+			hostname,
+			ssh.FingerprintSHA256(want.Key),
+			want.Filename,
+			want.Line,
+			fingerprint,
+			path,
+		)
+	}
+	return err
+}
+
+func addKnownHost(path string, emit func(Event), hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if err := fs.MakeDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	addresses := []string{knownhosts.Normalize(hostname)}
+	if remote != nil && knownhosts.Normalize(remote.String()) != addresses[0] {
+		addresses = append(addresses, knownhosts.Normalize(remote.String()))
+	}
+	if _, err := fmt.Fprintln(f, knownhosts.Line(addresses, key)); err != nil {
+		return err
+	}
+
+	emit(Event{
+		Type:    EventHostKeyAdded,
+		Message: fmt.Sprintf("Permanently added %s (%s) to the list of known hosts.", hostname, ssh.FingerprintSHA256(key)),
+	})
+	return nil
+}
@@ -0,0 +1,478 @@
+package client
+
+import (
+	"bufio"
+	_ "embed" // inspector page
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jkuri/bore/pkg/har"
+)
+
+const (
+	defaultInspectLimit = 100
+
+	// maxCapturedBody limits how much of each body the inspector keeps.
+	maxCapturedBody = 1 << 20
+)
+
+//go:embed inspect.html
+var inspectPage []byte
+
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"}
+
+// Exchange is an HTTP request forwarded to the local service together
+// with its response, as captured by the inspector.
+type Exchange struct {
+	ID       int64             `json:"id"`
+	Tunnel   string            `json:"tunnel"` // tunnel ID, or name if the ID is unknown
+	Local    string            `json:"local"`  // local host:port the request was forwarded to
+	Started  time.Time         `json:"started"`
+	Duration time.Duration     `json:"duration"` // nanoseconds until the response was forwarded
+	Done     bool              `json:"done"`
+	ReplayOf int64             `json:"replayOf,omitempty"` // ID of the replayed exchange
+	Request  CapturedRequest   `json:"request"`
+	Response *CapturedResponse `json:"response,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// CapturedRequest is the request part of an Exchange. Bodies are kept
+// up to 1 MiB, Truncated is set if the body was longer.
+type CapturedRequest struct {
+	Method    string      `json:"method"`
+	URL       string      `json:"url"`
+	Host      string      `json:"host"`
+	Proto     string      `json:"proto"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body,omitempty"`
+	BodySize  int64       `json:"bodySize"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// CapturedResponse is the response part of an Exchange.
+type CapturedResponse struct {
+	Status    int         `json:"status"`
+	Proto     string      `json:"proto"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body,omitempty"`
+	BodySize  int64       `json:"bodySize"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// inspector parses HTTP traffic forwarded to local services, keeps the
+// last exchanges in memory and serves them on a local web UI. Finished
+// exchanges are also written to a HAR file if one is configured.
+type inspector struct {
+	mu        sync.Mutex
+	addr      string // web UI address, disabled if empty
+	limit     int
+	nextID    int64
+	exchanges []*Exchange // oldest first
+	server    *http.Server
+
+	harFile string
+	redact  []string
+	har     *har.Writer
+	emit    func(Event) // reports failed HAR writes
+}
+
+func newInspector(config Config) *inspector {
+	i := &inspector{
+		addr:    config.Inspect,
+		limit:   config.InspectLimit,
+		harFile: config.HAR,
+		redact:  config.HARRedact,
+	}
+	if i.limit <= 0 {
+		i.limit = defaultInspectLimit
+	}
+	if i.redact == nil {
+		i.redact = har.DefaultRedact
+	}
+	return i
+}
+
+// start creates the HAR file and serves the web UI on the inspector
+// address, if they are enabled. Failures to write the HAR file are
+// reported with emit.
+func (i *inspector) start(emit func(Event)) error {
+	i.emit = emit
+	if i.harFile != "" {
+		w, err := har.Create(i.harFile)
+		if err != nil {
+			return fmt.Errorf("har: %w", err)
+		}
+		i.har = w
+	}
+	if i.addr == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", i.addr)
+	if err != nil {
+		i.close()
+		return fmt.Errorf("inspector: %w", err)
+	}
+	i.addr = listener.Addr().String()
+	i.server = &http.Server{Handler: i.handler()}
+	go i.server.Serve(listener)
+	return nil
+}
+
+func (i *inspector) close() {
+	if i.server != nil {
+		i.server.Close()
+	}
+	if i.har != nil {
+		i.har.Close()
+	}
+}
+
+func (i *inspector) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(inspectPage)
+	})
+	mux.HandleFunc("GET /api/requests", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, i.list())
+	})
+	mux.HandleFunc("DELETE /api/requests", func(w http.ResponseWriter, r *http.Request) {
+		i.mu.Lock()
+		i.exchanges = nil
+		i.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /api/requests/{id}", func(w http.ResponseWriter, r *http.Request) {
+		ex, ok := i.lookup(r.PathValue("id"))
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "request not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, ex)
+	})
+	mux.HandleFunc("POST /api/requests/{id}/replay", i.handleReplay)
+	return mux
+}
+
+// list returns captured exchanges, newest first, without bodies.
+func (i *inspector) list() []Exchange {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	list := make([]Exchange, 0, len(i.exchanges))
+	for n := len(i.exchanges) - 1; n >= 0; n-- {
+		ex := *i.exchanges[n]
+		ex.Request.Body = nil
+		if ex.Response != nil {
+			resp := *ex.Response
+			resp.Body = nil
+			ex.Response = &resp
+		}
+		list = append(list, ex)
+	}
+	return list
+}
+
+func (i *inspector) lookup(id string) (Exchange, bool) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return Exchange{}, false
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, ex := range i.exchanges {
+		if ex.ID == n {
+			return *ex, true
+		}
+	}
+	return Exchange{}, false
+}
+
+// add stores the exchange, dropping the oldest ones over the limit.
+func (i *inspector) add(ex *Exchange) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.nextID++
+	ex.ID = i.nextID
+	i.exchanges = append(i.exchanges, ex)
+	if over := len(i.exchanges) - i.limit; over > 0 {
+		i.exchanges = append([]*Exchange(nil), i.exchanges[over:]...)
+	}
+}
+
+// finish records the outcome of the exchange and appends it to the HAR
+// file. Replays are not tunnel traffic and are left out of the file.
+func (i *inspector) finish(ex *Exchange, req *capturedBody, resp *CapturedResponse, err error) {
+	i.mu.Lock()
+	ex.Duration = time.Since(ex.Started)
+	ex.Done = true
+	ex.Request.Body, ex.Request.BodySize, ex.Request.Truncated = req.result()
+	ex.Response = resp
+	if err != nil {
+		ex.Error = err.Error()
+	}
+	finished := *ex
+	i.mu.Unlock()
+
+	if i.har != nil && finished.ReplayOf == 0 {
+		// The file is closed with the tunnel while requests may still
+		// be in flight.
+		if err := i.har.Write(har.NewEntry(finished.har(), i.redact)); err != nil && !errors.Is(err, os.ErrClosed) {
+			i.emit(Event{Type: EventHARFailed, Err: err})
+		}
+	}
+}
+
+// har converts the exchange for the HAR log.
+func (ex Exchange) har() har.Exchange {
+	scheme := "http"
+	if ex.Request.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	h := har.Exchange{
+		Started:         ex.Started,
+		Duration:        ex.Duration,
+		Method:          ex.Request.Method,
+		URL:             scheme + "://" + ex.Request.Host + ex.Request.URL,
+		Proto:           ex.Request.Proto,
+		RequestHeader:   ex.Request.Header,
+		RequestBody:     ex.Request.Body,
+		RequestBodySize: ex.Request.BodySize,
+		Error:           ex.Error,
+	}
+	if resp := ex.Response; resp != nil {
+		h.Status = resp.Status
+		h.ResponseProto = resp.Proto
+		h.ResponseHeader = resp.Header
+		h.ResponseBody = resp.Body
+		h.ResponseBodySize = resp.BodySize
+	}
+	return h
+}
+
+// handle forwards HTTP/1.x requests read from client to local one by
+// one, capturing each exchange. Connections that don't start with an
+// HTTP request, connections where the local service speaks first and
+// upgraded connections, e.g. websockets, are forwarded as is from then
+// on.
+func (i *inspector) handle(t tunnel, client net.Conn, local net.Conn) {
+	cr := bufio.NewReader(client)
+	lr := bufio.NewReader(local)
+	clientConn := &bufferedConn{client, cr}
+	localConn := &bufferedConn{local, lr}
+
+	// Wait for whichever side sends first. Protocols where the server
+	// greets the client, e.g. SMTP or MySQL, must not wait for the client.
+	peeked := make(chan struct{})
+	var isHTTP bool
+	go func() {
+		isHTTP = startsWithHTTP(cr)
+		close(peeked)
+	}()
+	localData := make(chan error, 1)
+	go func() {
+		_, err := lr.Peek(1)
+		localData <- err
+	}()
+
+	select {
+	case <-peeked:
+		// Stop waiting for local, anything it sent stays buffered in lr.
+		local.SetReadDeadline(time.Now())
+		err := <-localData
+		local.SetReadDeadline(time.Time{})
+		if !isHTTP || err == nil {
+			handleClient(clientConn, localConn)
+			return
+		}
+	case <-localData:
+		// The client is read once the peek in progress returns.
+		handleClient(&waitConn{clientConn, peeked}, localConn)
+		return
+	}
+
+	for {
+		req, err := http.ReadRequest(cr)
+		if err != nil {
+			break
+		}
+
+		upgraded, err := i.forward(t, req, client, local, lr)
+		if err != nil {
+			break
+		}
+		if upgraded {
+			handleClient(clientConn, localConn)
+			return
+		}
+	}
+	client.Close()
+	local.Close()
+}
+
+// forward writes req to local and the response back to client. It
+// reports whether the connection switched protocols. An error is
+// returned if the connection can't be used for more requests.
+func (i *inspector) forward(t tunnel, req *http.Request, client, local net.Conn, lr *bufio.Reader) (bool, error) {
+	name := t.assignedID
+	if name == "" {
+		name = t.name
+	}
+	ex := &Exchange{
+		Tunnel:  name,
+		Local:   t.local.String(),
+		Started: time.Now(),
+		Request: CapturedRequest{
+			Method: req.Method,
+			URL:    req.RequestURI,
+			Host:   req.Host,
+			Proto:  req.Proto,
+			Header: req.Header.Clone(),
+		},
+	}
+	i.add(ex)
+
+	reqBody := newCapturedBody(req.Body)
+	req.Body = reqBody
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// Keep Write from adding Go's default.
+		req.Header.Set("User-Agent", "")
+	}
+
+	if err := req.Write(local); err != nil {
+		i.finish(ex, reqBody, nil, err)
+		return false, err
+	}
+
+	resp, err := http.ReadResponse(lr, req)
+	for err == nil && resp.StatusCode/100 == 1 && resp.StatusCode != http.StatusSwitchingProtocols {
+		if err = resp.Write(client); err == nil {
+			resp, err = http.ReadResponse(lr, req)
+		}
+	}
+	if err != nil {
+		i.finish(ex, reqBody, nil, err)
+		return false, err
+	}
+
+	respBody := newCapturedBody(resp.Body)
+	resp.Body = respBody
+	err = resp.Write(client)
+
+	captured := &CapturedResponse{
+		Status: resp.StatusCode,
+		Proto:  resp.Proto,
+		Header: resp.Header.Clone(),
+	}
+	captured.Body, captured.BodySize, captured.Truncated = respBody.result()
+	i.finish(ex, reqBody, captured, err)
+	if err != nil {
+		return false, err
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return true, nil
+	}
+	if req.Close || resp.Close {
+		return false, io.EOF
+	}
+	return false, nil
+}
+
+// startsWithHTTP reports whether the data buffered in r, once there is
+// any, looks like the start of an HTTP/1.x request.
+func startsWithHTTP(r *bufio.Reader) bool {
+	if _, err := r.Peek(1); err != nil {
+		return false
+	}
+	prefix, _ := r.Peek(min(r.Buffered(), len("OPTIONS ")))
+	for _, m := range httpMethods {
+		m += " "
+		if strings.HasPrefix(m, string(prefix)) || strings.HasPrefix(string(prefix), m) {
+			return true
+		}
+	}
+	return false
+}
+
+// capturedBody keeps the first maxCapturedBody bytes read from body.
+type capturedBody struct {
+	mu    sync.Mutex
+	body  io.ReadCloser
+	buf   []byte
+	size  int64
+	trunc bool
+}
+
+func newCapturedBody(body io.ReadCloser) *capturedBody {
+	if body == nil {
+		body = http.NoBody
+	}
+	return &capturedBody{body: body}
+}
+
+func (b *capturedBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+
+	b.mu.Lock()
+	b.size += int64(n)
+	if room := maxCapturedBody - len(b.buf); room > 0 {
+		b.buf = append(b.buf, p[:min(n, room)]...)
+	}
+	if n > 0 && b.size > maxCapturedBody {
+		b.trunc = true
+	}
+	b.mu.Unlock()
+
+	return n, err
+}
+
+func (b *capturedBody) Close() error {
+	return b.body.Close()
+}
+
+func (b *capturedBody) result() ([]byte, int64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf, b.size, b.trunc
+}
+
+// bufferedConn is a connection read through a bufio.Reader that may
+// already hold some of its data.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// waitConn is a connection whose reads wait until ready is closed.
+type waitConn struct {
+	net.Conn
+	ready <-chan struct{}
+}
+
+func (c *waitConn) Read(p []byte) (int, error) {
+	<-c.ready
+	return c.Conn.Read(p)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,193 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ReplayRequest changes a captured request before it is replayed. Empty
+// fields keep the captured values. Header replaces all captured headers
+// if set.
+type ReplayRequest struct {
+	Method string      `json:"method,omitempty"`
+	URL    string      `json:"url,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   *[]byte     `json:"body,omitempty"`
+}
+
+// replay re-sends the captured request to the local service it was
+// forwarded to and captures the result as a new exchange.
+func (i *inspector) replay(ctx context.Context, orig Exchange, edit ReplayRequest) (*Exchange, error) {
+	captured := orig.Request
+	captured.Header = captured.Header.Clone()
+	if edit.Method != "" {
+		captured.Method = edit.Method
+	}
+	if edit.URL != "" {
+		captured.URL = edit.URL
+	}
+	if edit.Header != nil {
+		captured.Header = edit.Header.Clone()
+	}
+	if edit.Body != nil {
+		captured.Body = *edit.Body
+		captured.Truncated = false
+	}
+	if captured.Truncated {
+		return nil, fmt.Errorf("body of request %d was truncated, replay it with a new body", orig.ID)
+	}
+	if !strings.HasPrefix(captured.URL, "/") {
+		return nil, fmt.Errorf("url must be a path, got %q", captured.URL)
+	}
+
+	body := newCapturedBody(io.NopCloser(bytes.NewReader(captured.Body)))
+	req, err := http.NewRequestWithContext(ctx, captured.Method, "http://"+orig.Local+captured.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(captured.Body))
+	if req.ContentLength == 0 {
+		req.Body = http.NoBody
+	}
+	req.Host = captured.Host
+	req.Header = captured.Header.Clone()
+	req.Header.Del("Content-Length")
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header.Set("User-Agent", "")
+	}
+
+	ex := &Exchange{
+		Tunnel:   orig.Tunnel,
+		Local:    orig.Local,
+		Started:  time.Now(),
+		ReplayOf: orig.ID,
+		Request: CapturedRequest{
+			Method: captured.Method,
+			URL:    captured.URL,
+			Host:   captured.Host,
+			Proto:  "HTTP/1.1",
+			Header: captured.Header,
+		},
+	}
+	i.add(ex)
+
+	client := &http.Client{
+		Transport: &http.Transport{DisableCompression: true},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		i.finish(ex, body, nil, err)
+		return ex, nil
+	}
+	defer resp.Body.Close()
+
+	respBody := newCapturedBody(resp.Body)
+	_, err = io.Copy(io.Discard, respBody)
+	result := &CapturedResponse{
+		Status: resp.StatusCode,
+		Proto:  resp.Proto,
+		Header: resp.Header,
+	}
+	result.Body, result.BodySize, result.Truncated = respBody.result()
+	i.finish(ex, body, result, err)
+	return ex, nil
+}
+
+func (i *inspector) handleReplay(w http.ResponseWriter, r *http.Request) {
+	orig, ok := i.lookup(r.PathValue("id"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "request not found"})
+		return
+	}
+
+	// Requiring JSON makes browsers preflight cross-origin requests, so
+	// other sites can't trigger replays.
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+		writeJSON(w, http.StatusUnsupportedMediaType, map[string]string{"error": "content type must be application/json"})
+		return
+	}
+
+	var edit ReplayRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&edit); err != nil && err != io.EOF {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body: " + err.Error()})
+			return
+		}
+	}
+
+	ex, err := i.replay(r.Context(), orig, edit)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	i.mu.Lock()
+	result := *ex
+	i.mu.Unlock()
+	writeJSON(w, http.StatusOK, result)
+}
+
+// Captured returns exchange with given ID from the inspector running
+// at inspectorURL, e.g. http://127.0.0.1:4040.
+func Captured(ctx context.Context, inspectorURL string, id int64) (*Exchange, error) {
+	var ex Exchange
+	url := fmt.Sprintf("%s/api/requests/%d", strings.TrimSuffix(inspectorURL, "/"), id)
+	if err := inspectorRequest(ctx, http.MethodGet, url, nil, &ex); err != nil {
+		return nil, err
+	}
+	return &ex, nil
+}
+
+// Replay asks the inspector running at inspectorURL to send captured
+// request with given ID to the local service again, changed by edit.
+// It returns the new exchange.
+func Replay(ctx context.Context, inspectorURL string, id int64, edit ReplayRequest) (*Exchange, error) {
+	body, err := json.Marshal(edit)
+	if err != nil {
+		return nil, err
+	}
+	var ex Exchange
+	url := fmt.Sprintf("%s/api/requests/%d/replay", strings.TrimSuffix(inspectorURL, "/"), id)
+	if err := inspectorRequest(ctx, http.MethodPost, url, body, &ex); err != nil {
+		return nil, err
+	}
+	return &ex, nil
+}
+
+func inspectorRequest(ctx context.Context, method, url string, body []byte, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("inspector not reachable, is bore running with -inspect? %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct{ Error string }
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != "" {
+			return errors.New(e.Error)
+		}
+		return fmt.Errorf("inspector replied %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
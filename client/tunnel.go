@@ -0,0 +1,315 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventType identifies kind of Event.
+type EventType int
+
+const (
+	// EventConnected is sent when all tunnels are open, after the
+	// initial connect and after every successful reconnect.
+	EventConnected EventType = iota
+	// EventDisconnected is sent when the connection to the server fails.
+	EventDisconnected
+	// EventReconnecting is sent before waiting for the next reconnect attempt.
+	EventReconnecting
+	// EventHostKeyAdded is sent when the server host key is trusted on
+	// first use and added to the known hosts file.
+	EventHostKeyAdded
+	// EventHARFailed is sent when a request can't be written to the
+	// HAR file.
+	EventHARFailed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConnected:
+		return "connected"
+	case EventDisconnected:
+		return "disconnected"
+	case EventReconnecting:
+		return "reconnecting"
+	case EventHostKeyAdded:
+		return "host key added"
+	case EventHARFailed:
+		return "HAR write failed"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// Event describes change of the tunnel state.
+type Event struct {
+	Type      EventType
+	Err       error         // cause of disconnect, failed reconnect attempt or HAR write
+	Attempt   int           // reconnect attempt, starting at 1
+	Delay     time.Duration // delay before the reconnect attempt
+	Message   string
+	Endpoints []Endpoint // open tunnels, set for EventConnected
+}
+
+func (e Event) String() string {
+	switch e.Type {
+	case EventDisconnected:
+		return fmt.Sprintf("disconnected: %v", e.Err)
+	case EventReconnecting:
+		return fmt.Sprintf("connection failed due: %v, reconnecting in %s...", e.Err, e.Delay.Round(time.Millisecond))
+	case EventHostKeyAdded:
+		return e.Message
+	case EventHARFailed:
+		return fmt.Sprintf("har: %v", e.Err)
+	default:
+		return e.Type.String()
+	}
+}
+
+// Endpoint describes a tunnel opened on the server.
+type Endpoint struct {
+	Name       string   `json:"name,omitempty"` // tunnel name from config, if any
+	ID         string   `json:"id"`             // empty if the server is too old to report a random ID
+	Local      string   `json:"local"`          // local host:port the tunnel forwards to
+	RemotePort int      `json:"remotePort"`     // port the server listens on
+	HTTPURL    string   `json:"httpUrl,omitempty"`
+	HTTPSURL   string   `json:"httpsUrl,omitempty"`
+	TCPAddr    string   `json:"tcpAddr,omitempty"` // empty if the server doesn't expose tunnel ports
+	UDPAddr    string   `json:"udpAddr,omitempty"` // set instead of the other addresses for UDP tunnels
+	Domains    []string `json:"domains,omitempty"` // custom domains routed to the tunnel
+}
+
+// Info is machine-readable description of the open tunnels.
+type Info struct {
+	ServerVersion string     `json:"serverVersion,omitempty"`
+	Tunnels       []Endpoint `json:"tunnels"`
+	Inspector     string     `json:"inspector,omitempty"` // URL of the request inspector, if enabled
+}
+
+// Tunnel is a handle to the running client returned by Start.
+type Tunnel struct {
+	mu        sync.Mutex
+	client    *BoreClient
+	cancel    context.CancelFunc
+	events    chan Event
+	done      chan struct{}
+	err       error
+	endpoints []Endpoint
+	closed    bool // events is closed
+
+	serverVersion string
+}
+
+// Start connects to the server and opens all configured tunnels. If
+// Config.Reconnect is set, failed connection attempts are retried with
+// backoff, and so is the connection when it fails later. Tunnels are
+// resumed with the same ID and port if the server still holds them.
+//
+// The tunnels stay open until ctx is cancelled, Close is called or the
+// connection fails for good. Start must not be called again until the
+// returned Tunnel is closed.
+func (c *BoreClient) Start(ctx context.Context) (*Tunnel, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	t := &Tunnel{
+		client: c,
+		cancel: cancel,
+		events: make(chan Event, 16),
+		done:   make(chan struct{}),
+	}
+
+	if c.inspector != nil {
+		if err := c.inspector.start(t.emit); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	cn, err := c.connect(ctx, t.emit)
+	if err != nil && c.config.Reconnect {
+		cn, err = c.reconnect(ctx, t, err)
+	}
+	if err != nil {
+		cancel()
+		if c.inspector != nil {
+			c.inspector.close()
+		}
+		return nil, err
+	}
+	t.connected()
+
+	go t.run(ctx, cn)
+	return t, nil
+}
+
+// Endpoints returns tunnels opened on the server.
+func (t *Tunnel) Endpoints() []Endpoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Endpoint(nil), t.endpoints...)
+}
+
+// Info returns description of the open tunnels as reported by the server.
+func (t *Tunnel) Info() Info {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info := Info{
+		ServerVersion: t.serverVersion,
+		Tunnels:       append([]Endpoint(nil), t.endpoints...),
+	}
+	if i := t.client.inspector; i != nil && i.server != nil {
+		info.Inspector = "http://" + i.addr
+	}
+	return info
+}
+
+// connected updates endpoints after the client connected and notifies
+// about it.
+func (t *Tunnel) connected() {
+	c := t.client
+	endpoints := make([]Endpoint, 0, len(c.tunnels))
+	for _, tun := range c.tunnels {
+		e := Endpoint{
+			Name:       tun.name,
+			ID:         tun.assignedID,
+			Local:      tun.local.String(),
+			RemotePort: tun.port,
+			Domains:    tun.domains,
+			TCPAddr:    fmt.Sprintf("%s:%d", c.ServerEndpoint.host, tun.port),
+		}
+		switch {
+		case tun.udp:
+			e.UDPAddr, e.TCPAddr = e.TCPAddr, ""
+			if tun.info != nil && tun.info.TCPAddr != "" {
+				e.UDPAddr = tun.info.TCPAddr
+			}
+		case tun.info != nil:
+			e.HTTPURL = tun.info.HTTPURL
+			e.HTTPSURL = tun.info.HTTPSURL
+			e.TCPAddr = tun.info.TCPAddr
+		case e.ID != "":
+			e.HTTPURL = fmt.Sprintf("http://%s.%s", e.ID, c.ServerEndpoint.host)
+			e.HTTPSURL = fmt.Sprintf("https://%s.%s", e.ID, c.ServerEndpoint.host)
+		}
+		endpoints = append(endpoints, e)
+	}
+
+	t.mu.Lock()
+	t.endpoints = endpoints
+	t.serverVersion = c.serverVersion
+	t.mu.Unlock()
+
+	t.emit(Event{Type: EventConnected, Endpoints: endpoints})
+}
+
+// Events returns channel of tunnel state changes. Events are dropped if
+// the channel is not drained. The channel is closed when the tunnel is
+// closed.
+func (t *Tunnel) Events() <-chan Event {
+	return t.events
+}
+
+// Done returns channel that is closed when the tunnel is closed.
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.done
+}
+
+// Wait blocks until the tunnel is closed and returns the error that
+// caused it, or nil if it was closed with Close or by cancelling the
+// context.
+func (t *Tunnel) Wait() error {
+	<-t.done
+	return t.err
+}
+
+// Close closes the connection to the server and waits for the tunnel
+// to shut down.
+func (t *Tunnel) Close() error {
+	t.cancel()
+	<-t.done
+	return nil
+}
+
+// emit sends e unless the events channel is full or closed. Requests
+// still in flight when the tunnel closes may emit events late.
+func (t *Tunnel) emit(e Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.events <- e:
+	default:
+	}
+}
+
+func (t *Tunnel) closeEvents() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	close(t.events)
+}
+
+func (t *Tunnel) run(ctx context.Context, cn *conn) {
+	defer close(t.done)
+	defer t.closeEvents()
+	defer t.cancel()
+
+	c := t.client
+	if c.inspector != nil {
+		defer c.inspector.close()
+	}
+	for {
+		err := c.serve(ctx, cn)
+		cn.Close()
+		if ctx.Err() != nil {
+			return
+		}
+
+		t.emit(Event{Type: EventDisconnected, Err: err})
+		if !c.config.Reconnect {
+			t.err = err
+			return
+		}
+
+		cn, err = c.reconnect(ctx, t, err)
+		if err != nil {
+			if ctx.Err() == nil {
+				t.err = err
+			}
+			return
+		}
+		t.connected()
+	}
+}
+
+// reconnect retries connecting with backoff until it succeeds, ctx is
+// cancelled or Backoff.MaxAttempts consecutive attempts failed.
+func (c *BoreClient) reconnect(ctx context.Context, t *Tunnel, err error) (*conn, error) {
+	b := c.config.Backoff.withDefaults()
+
+	for attempt := 1; ; attempt++ {
+		if b.MaxAttempts > 0 && attempt > b.MaxAttempts {
+			return nil, fmt.Errorf("giving up after %d attempts: %w", b.MaxAttempts, err)
+		}
+
+		delay := b.delay(attempt - 1)
+		t.emit(Event{Type: EventReconnecting, Err: err, Attempt: attempt, Delay: delay})
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+
+		var cn *conn
+		cn, err = c.connect(ctx, t.emit)
+		if err == nil {
+			return cn, nil
+		}
+	}
+}
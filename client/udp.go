@@ -0,0 +1,216 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jkuri/bore/pkg/udpframe"
+	"golang.org/x/crypto/ssh"
+)
+
+// udpIdleTimeout closes local sockets of peers without traffic, if the
+// server doesn't send its timeout.
+const udpIdleTimeout = 2 * time.Minute
+
+type forwardedUDPPayload struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// udpForwardReplyPayload is the reply to udp-forward. Rest holds the
+// server's peer idle timeout in milliseconds, if it sends one.
+type udpForwardReplyPayload struct {
+	Port uint32
+	Rest []byte `ssh:"rest"`
+}
+
+// listenUDP asks the server to bind a UDP port for the tunnel and
+// returns the bound port and how long peers are kept without traffic.
+func listenUDP(sshClient *ssh.Client, remote endpoint) (int, time.Duration, error) {
+	ok, reply, err := sshClient.SendRequest("udp-forward", true, ssh.Marshal(&tcpIPForwardPayload{remote.host, uint32(remote.port)}))
+	if err != nil {
+		return 0, 0, err
+	}
+	if !ok {
+		return 0, 0, requestError("udp-forward", reply)
+	}
+	var payload udpForwardReplyPayload
+	if err := ssh.Unmarshal(reply, &payload); err != nil {
+		return 0, 0, err
+	}
+	timeout := udpIdleTimeout
+	if len(payload.Rest) >= 4 {
+		if ms := binary.BigEndian.Uint32(payload.Rest); ms > 0 {
+			timeout = time.Duration(ms) * time.Millisecond
+		}
+	}
+	return int(payload.Port), timeout, nil
+}
+
+// serveUDP accepts forwarded-udp channels the server opens for UDP
+// tunnels and relays their datagrams to the local endpoints.
+func serveUDP(chans <-chan ssh.NewChannel, tunnels []tunnel) {
+	for nch := range chans {
+		var payload forwardedUDPPayload
+		if err := ssh.Unmarshal(nch.ExtraData(), &payload); err != nil {
+			nch.Reject(ssh.ConnectionFailed, "invalid payload")
+			continue
+		}
+
+		var t *tunnel
+		for i := range tunnels {
+			if tunnels[i].udp && tunnels[i].port == int(payload.Port) {
+				t = &tunnels[i]
+			}
+		}
+		if t == nil {
+			nch.Reject(ssh.Prohibited, "no such UDP tunnel")
+			continue
+		}
+
+		ch, reqs, err := nch.Accept()
+		if err != nil {
+			continue
+		}
+		go ssh.DiscardRequests(reqs)
+		go newUDPRelay(*t, ch).run()
+	}
+}
+
+// udpRelay forwards datagrams framed on a forwarded-udp channel to the
+// local endpoint. Every peer gets its own local socket, so the local
+// service can tell peers apart and its replies go back to the right one.
+type udpRelay struct {
+	t   tunnel
+	ch  ssh.Channel
+	wmu sync.Mutex // serializes frames written to ch
+
+	mu    sync.Mutex
+	peers map[string]*udpPeer // keyed by peer host:port
+}
+
+type udpPeer struct {
+	conn     *net.UDPConn
+	lastSeen atomic.Int64 // unix nanoseconds
+}
+
+func (p *udpPeer) touch() {
+	p.lastSeen.Store(time.Now().UnixNano())
+}
+
+func newUDPRelay(t tunnel, ch ssh.Channel) *udpRelay {
+	return &udpRelay{t: t, ch: ch, peers: make(map[string]*udpPeer)}
+}
+
+// run relays datagrams from the channel until it is closed.
+func (r *udpRelay) run() {
+	done := make(chan struct{})
+	defer r.closePeers()
+	defer close(done)
+	defer r.ch.Close()
+	go r.expire(done)
+
+	br := bufio.NewReader(r.ch)
+	for {
+		d, err := udpframe.Read(br)
+		if err != nil {
+			return
+		}
+		peer, err := r.peer(d.Addr, d.Port)
+		if err != nil {
+			continue
+		}
+		peer.touch()
+		peer.conn.Write(d.Data)
+	}
+}
+
+// peer returns socket of the peer, dialing the local endpoint for new
+// peers.
+func (r *udpRelay) peer(addr string, port uint32) (*udpPeer, error) {
+	key := net.JoinHostPort(addr, strconv.Itoa(int(port)))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p, ok := r.peers[key]; ok {
+		return p, nil
+	}
+
+	local, err := net.ResolveUDPAddr("udp", r.t.local.String())
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, local)
+	if err != nil {
+		return nil, err
+	}
+	p := &udpPeer{conn: conn}
+	p.touch()
+	r.peers[key] = p
+	go r.reply(addr, port, p)
+	return p, nil
+}
+
+// reply sends datagrams the local service sends to the peer's socket
+// back to the peer.
+func (r *udpRelay) reply(addr string, port uint32, p *udpPeer) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := p.conn.Read(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// E.g. connection refused while the local service is down.
+			continue
+		}
+		p.touch()
+
+		r.wmu.Lock()
+		err = udpframe.Write(r.ch, udpframe.Datagram{Addr: addr, Port: port, Data: buf[:n]})
+		r.wmu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// expire closes sockets of peers idle for longer than the tunnel's
+// idle timeout.
+func (r *udpRelay) expire(done <-chan struct{}) {
+	ticker := time.NewTicker(r.t.udpTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			deadline := time.Now().Add(-r.t.udpTimeout).UnixNano()
+			r.mu.Lock()
+			for key, p := range r.peers {
+				if p.lastSeen.Load() < deadline {
+					p.conn.Close()
+					delete(r.peers, key)
+				}
+			}
+			r.mu.Unlock()
+		case <-done:
+			return
+		}
+	}
+}
+
+func (r *udpRelay) closePeers() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, p := range r.peers {
+		p.conn.Close()
+		delete(r.peers, key)
+	}
+}
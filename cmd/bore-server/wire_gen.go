@@ -31,7 +31,10 @@ func CreateApp(cfg string) (*server.BoreServer, error) {
 	if err != nil {
 		return nil, err
 	}
-	boreServer := server.NewBoreServer(options, zapLogger)
+	boreServer, err := server.NewBoreServer(options, zapLogger)
+	if err != nil {
+		return nil, err
+	}
 	return boreServer, nil
 }
 
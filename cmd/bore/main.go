@@ -1,21 +1,38 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jkuri/bore/client"
 	"github.com/jkuri/bore/internal/version"
+	"github.com/jkuri/bore/pkg/har"
 )
 
 var help = `
 Usage: bore [options]
+       bore [options] start [tunnel...]
+       bore replay [options] <request-id>
+
+Commands:
+
+start, Start named tunnels from config file, or all of them if none given
+
+replay, Send request captured by the inspector to the local service again, see bore replay -h
 
 Options:
 
+-config, Path to config file (default: ./bore.yaml or ~/.bore/bore.yaml)
+
 -s, SSH server remote host (default: bore.digital)
 
 -p, SSH server remote port (default: 2200)
@@ -26,12 +43,54 @@ Options:
 
 -bp, Remote TCP bind port, (default: 0 (random))
 
+-udp, Forward UDP datagrams instead of TCP connections, -bp is then the remote UDP port (default: false)
+
 -id, ID to use when generating URL (default: "" (random))
 
+-domain, Custom domain routed to the tunnel, can be repeated (default: "" (none))
+
+-auth, Require HTTP basic auth as user:password to access the tunnel (default: "" (none))
+
+-bearer, Require HTTP bearer token to access the tunnel (default: "" (none))
+
+-oidc, Require visitors to log in with the server's OIDC provider (default: false)
+
+-oidc-domain, Only let in OIDC users with email in these comma separated domains, implies -oidc (default: "" (any))
+
+-oidc-group, Only let in OIDC users in these comma separated groups, implies -oidc (default: "" (any))
+
+-allow-ip, Only let in visitors from these comma separated CIDRs (default: "" (any))
+
+-deny-ip, Refuse visitors from these comma separated CIDRs (default: "" (none))
+
+-t, Additional tunnel as [id@][host:]port[/udp], can be repeated (e.g. -t web@3000 -t api@localhost:8080 -t dns@53/udp)
+
+-i, Path to private key used for authentication (default: "" (none))
+
+-token, API token used for authentication (default: "" (none))
+
+-host-key-fingerprint, Pinned SHA256 fingerprint of server host key (default: "" (trust on first use))
+
+-known-hosts, Path to known hosts file (default: ~/.bore/known_hosts)
+
 -a, Keep tunnel connection alive (default: true)
 
 -r, Auto-reconnect if connection failed (default: false)
 
+-max-backoff, Maximum delay between reconnect attempts (default: 1m)
+
+-max-attempts, Give up after this many failed reconnect attempts (default: 0 (unlimited))
+
+-output, Output format, text or json (default: text)
+
+-inspect, Address of local web UI showing HTTP requests to the tunnels, e.g. 127.0.0.1:4040 (default: "" (disabled))
+
+-inspect-limit, Number of requests the inspector keeps (default: 100)
+
+-har, Write HTTP requests to the tunnels to this HAR file as they complete (default: "" (disabled))
+
+-har-redact, Comma separated headers with values redacted in the HAR file, "none" keeps all (default: Authorization,Proxy-Authorization,Cookie,Set-Cookie)
+
 -version, prints bore version and build info
 
 Read more:
@@ -44,13 +103,77 @@ var (
 	localServer   = flag.String("ls", "localhost", "")
 	localPort     = flag.Int("lp", 80, "")
 	bindPort      = flag.Int("bp", 0, "")
+	udp           = flag.Bool("udp", false, "")
 	id            = flag.String("id", "", "")
+	auth          = flag.String("auth", "", "")
+	bearer        = flag.String("bearer", "", "")
+	oidc          = flag.Bool("oidc", false, "")
+	oidcDomains   = flag.String("oidc-domain", "", "")
+	oidcGroups    = flag.String("oidc-group", "", "")
+	allowIPs      = flag.String("allow-ip", "", "")
+	denyIPs       = flag.String("deny-ip", "", "")
+	identity      = flag.String("i", "", "")
+	token         = flag.String("token", "", "")
+	hostKeyFP     = flag.String("host-key-fingerprint", "", "")
+	knownHosts    = flag.String("known-hosts", "", "")
 	keepAlive     = flag.Bool("a", true, "")
 	autoReconnect = flag.Bool("r", false, "")
+	maxBackoff    = flag.Duration("max-backoff", time.Minute, "")
+	maxAttempts   = flag.Int("max-attempts", 0, "")
+	configFile    = flag.String("config", "", "")
+	output        = flag.String("output", "text", "")
+	inspect       = flag.String("inspect", "", "")
+	inspectLimit  = flag.Int("inspect-limit", 100, "")
+	harFile       = flag.String("har", "", "")
+	harRedact     = flag.String("har-redact", "", "")
 	versionFlag   = flag.Bool("version", false, "version")
 )
 
+// tunnelFlags collects repeated -t flags.
+type tunnelFlags []client.TunnelConfig
+
+func (f *tunnelFlags) String() string {
+	return fmt.Sprint(*f)
+}
+
+// Set parses tunnel in [id@][host:]port[/udp] format.
+func (f *tunnelFlags) Set(value string) error {
+	t := client.TunnelConfig{LocalServer: "localhost"}
+	value, t.UDP = strings.CutSuffix(value, "/udp")
+	if i := strings.Index(value, "@"); i != -1 {
+		t.ID, value = value[:i], value[i+1:]
+	}
+	if host, port, err := net.SplitHostPort(value); err == nil {
+		t.LocalServer, value = host, port
+	}
+	port, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", value)
+	}
+	t.LocalPort = port
+	*f = append(*f, t)
+	return nil
+}
+
+var tunnels tunnelFlags
+
+// stringFlags collects repeated string flags.
+type stringFlags []string
+
+func (f *stringFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+var domains stringFlags
+
 func main() {
+	flag.Var(&tunnels, "t", "")
+	flag.Var(&domains, "domain", "")
 	flag.Usage = func() {
 		fmt.Print(help)
 		os.Exit(1)
@@ -62,25 +185,240 @@ func main() {
 		os.Exit(0)
 	}
 
-	client := client.NewBoreClient(client.Config{
-		RemoteServer: *remoteServer,
-		RemotePort:   *remotePort,
-		LocalServer:  *localServer,
-		LocalPort:    *localPort,
-		BindPort:     *bindPort,
-		ID:           *id,
-		KeepAlive:    *keepAlive,
-	})
-
-connect:
-	if err := client.Run(); err != nil {
-		if !*autoReconnect {
+	if flag.Arg(0) == "replay" {
+		if err := runReplay(flag.Args()[1:]); err != nil {
 			log.Fatal(err)
 		}
-		log.Println("connection failed due: ", err.Error(), "reconnecting in 5s...")
-		time.Sleep(time.Second * 5)
-		goto connect
+		os.Exit(0)
+	}
+
+	names, err := parseCommand(flag.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	v, err := client.NewConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config, err := client.NewConfigFromViper(v, names...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := applyFlags(&config); err != nil {
+		log.Fatal(err)
+	}
+
+	client := client.NewBoreClient(config)
+	switch *output {
+	case "text":
+		err = client.Run()
+	case "json":
+		err = runJSON(&client)
+	default:
+		err = fmt.Errorf("unknown output format %q", *output)
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	os.Exit(0)
 }
+
+// runJSON starts the client and prints tunnel info as a JSON line to
+// stdout every time the client (re)connects.
+func runJSON(c *client.BoreClient) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	t, err := c.Start(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	go func() {
+		for e := range t.Events() {
+			switch e.Type {
+			case client.EventConnected:
+				if err := enc.Encode(t.Info()); err != nil {
+					log.Println(err)
+				}
+			case client.EventReconnecting, client.EventHostKeyAdded, client.EventHARFailed:
+				log.Println(e)
+			}
+		}
+	}()
+
+	return t.Wait()
+}
+
+// parseCommand returns tunnel names given to the start command. Flags
+// following the command are parsed as well.
+func parseCommand(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	if args[0] != "start" {
+		return nil, fmt.Errorf("unknown command %q", args[0])
+	}
+
+	var names []string
+	args = args[1:]
+	for len(args) > 0 {
+		if strings.HasPrefix(args[0], "-") {
+			if err := flag.CommandLine.Parse(args); err != nil {
+				return nil, err
+			}
+			args = flag.Args()
+			continue
+		}
+		names = append(names, args[0])
+		args = args[1:]
+	}
+	return names, nil
+}
+
+// applyFlags overrides config file values with flags set on command line.
+func applyFlags(config *client.Config) error {
+	isSet := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { isSet[f.Name] = true })
+
+	if isSet["s"] {
+		config.RemoteServer = *remoteServer
+	}
+	if isSet["p"] {
+		config.RemotePort = *remotePort
+	}
+	if isSet["a"] {
+		config.KeepAlive = *keepAlive
+	}
+	if isSet["r"] {
+		config.Reconnect = *autoReconnect
+	}
+	if isSet["max-backoff"] {
+		config.Backoff.Max = *maxBackoff
+	}
+	if isSet["max-attempts"] {
+		config.Backoff.MaxAttempts = *maxAttempts
+	}
+	if isSet["i"] {
+		config.PrivateKey = *identity
+	}
+	if isSet["token"] {
+		config.Token = *token
+	}
+	if isSet["host-key-fingerprint"] {
+		config.HostKeyFingerprint = *hostKeyFP
+	}
+	if isSet["known-hosts"] {
+		config.KnownHostsFile = *knownHosts
+	}
+	if isSet["inspect"] {
+		config.Inspect = *inspect
+	}
+	if isSet["inspect-limit"] {
+		config.InspectLimit = *inspectLimit
+	}
+	if isSet["har"] {
+		config.HAR = *harFile
+	}
+	if isSet["har-redact"] {
+		config.HARRedact = har.ParseRedact(*harRedact)
+	}
+
+	if isSet["auth"] && !strings.Contains(*auth, ":") {
+		return fmt.Errorf("-auth must be in user:password format")
+	}
+
+	var oidcAccess *client.OIDCAccess
+	oidcSet := isSet["oidc"] || isSet["oidc-domain"] || isSet["oidc-group"]
+	if *oidc || *oidcDomains != "" || *oidcGroups != "" {
+		oidcAccess = &client.OIDCAccess{Domains: splitList(*oidcDomains), Groups: splitList(*oidcGroups)}
+	}
+
+	tunnelFlagsSet := isSet["ls"] || isSet["lp"] || isSet["bp"] || isSet["udp"] || isSet["id"] || isSet["domain"] || isSet["auth"] || isSet["bearer"] || oidcSet || isSet["allow-ip"] || isSet["deny-ip"]
+	switch {
+	case len(config.Tunnels) == 0:
+		config.LocalServer = *localServer
+		config.LocalPort = *localPort
+		config.BindPort = *bindPort
+		config.UDP = *udp
+		config.ID = *id
+		config.Domains = domains
+		config.Auth = *auth
+		config.Bearer = *bearer
+		config.OIDC = oidcAccess
+		config.AllowIPs = splitList(*allowIPs)
+		config.DenyIPs = splitList(*denyIPs)
+		if tunnelFlagsSet && len(tunnels) > 0 {
+			config.Tunnels = append(config.Tunnels, client.TunnelConfig{
+				LocalServer: *localServer,
+				LocalPort:   *localPort,
+				BindPort:    *bindPort,
+				UDP:         *udp,
+				ID:          *id,
+				Domains:     domains,
+				Auth:        *auth,
+				Bearer:      *bearer,
+				OIDC:        oidcAccess,
+				AllowIPs:    splitList(*allowIPs),
+				DenyIPs:     splitList(*denyIPs),
+			})
+		}
+	case tunnelFlagsSet && len(config.Tunnels) == 1:
+		t := &config.Tunnels[0]
+		if isSet["ls"] {
+			t.LocalServer = *localServer
+		}
+		if isSet["lp"] {
+			t.LocalPort = *localPort
+		}
+		if isSet["bp"] {
+			t.BindPort = *bindPort
+		}
+		if isSet["udp"] {
+			t.UDP = *udp
+		}
+		if isSet["id"] {
+			t.ID = *id
+		}
+		if isSet["domain"] {
+			t.Domains = domains
+		}
+		if isSet["auth"] {
+			t.Auth = *auth
+		}
+		if isSet["bearer"] {
+			t.Bearer = *bearer
+		}
+		if oidcSet {
+			t.OIDC = oidcAccess
+		}
+		if isSet["allow-ip"] {
+			t.AllowIPs = splitList(*allowIPs)
+		}
+		if isSet["deny-ip"] {
+			t.DenyIPs = splitList(*denyIPs)
+		}
+	case tunnelFlagsSet:
+		return fmt.Errorf("-ls, -lp, -bp, -udp, -id, -domain, -auth, -bearer, -oidc and IP filter flags can only be used with a single tunnel")
+	}
+	config.Tunnels = append(config.Tunnels, tunnels...)
+
+	return nil
+}
+
+// splitList splits comma separated flag value.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jkuri/bore/client"
+)
+
+var replayHelp = `
+Usage: bore replay [options] <request-id>
+
+Sends request captured by the inspector of a running bore client to the
+local service again and prints the response.
+
+Options:
+
+-inspect, Address of the running client's inspector (default: 127.0.0.1:4040)
+
+-X, Replace request method
+
+-url, Replace request path and query
+
+-H, Set header as "Name: value", or remove it with "Name:", can be repeated
+
+-d, Replace request body, @file reads it from file
+`
+
+// runReplay implements the replay command.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Print(replayHelp)
+		os.Exit(1)
+	}
+	inspectAddr := fs.String("inspect", "127.0.0.1:4040", "")
+	method := fs.String("X", "", "")
+	url := fs.String("url", "", "")
+	data := fs.String("d", "", "")
+	var headers stringFlags
+	fs.Var(&headers, "H", "")
+
+	// Allow options after the request ID.
+	var positional []string
+	for len(args) > 0 {
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(positional) != 1 {
+		fs.Usage()
+	}
+	id, err := strconv.ParseInt(positional[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid request id %q", positional[0])
+	}
+
+	isSet := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { isSet[f.Name] = true })
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	inspectorURL := "http://" + *inspectAddr
+	orig, err := client.Captured(ctx, inspectorURL, id)
+	if err != nil {
+		return err
+	}
+
+	edit := client.ReplayRequest{Method: *method, URL: *url}
+	if len(headers) > 0 {
+		edit.Header = orig.Request.Header.Clone()
+		if edit.Header == nil {
+			edit.Header = make(http.Header)
+		}
+		for _, h := range headers {
+			name, value, ok := strings.Cut(h, ":")
+			if !ok || strings.TrimSpace(name) == "" {
+				return fmt.Errorf("invalid header %q, expected \"Name: value\"", h)
+			}
+			if value = strings.TrimSpace(value); value == "" {
+				edit.Header.Del(name)
+			} else {
+				edit.Header.Set(name, value)
+			}
+		}
+	}
+	if isSet["d"] {
+		body := []byte(*data)
+		if path, ok := strings.CutPrefix(*data, "@"); ok {
+			if body, err = os.ReadFile(path); err != nil {
+				return err
+			}
+		}
+		edit.Body = &body
+	}
+
+	ex, err := client.Replay(ctx, inspectorURL, id, edit)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Original #%d: %s\n", orig.ID, exchangeSummary(orig))
+	fmt.Printf("Replay   #%d: %s\n\n", ex.ID, exchangeSummary(ex))
+	if ex.Response == nil {
+		return nil
+	}
+
+	resp := ex.Response
+	fmt.Printf("%s %d %s\n", resp.Proto, resp.Status, http.StatusText(resp.Status))
+	names := make([]string, 0, len(resp.Header))
+	for name := range resp.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range resp.Header[name] {
+			fmt.Printf("%s: %s\n", name, v)
+		}
+	}
+	fmt.Println()
+	os.Stdout.Write(resp.Body)
+	if resp.Truncated {
+		fmt.Printf("\n[body truncated, %d bytes total]\n", resp.BodySize)
+	}
+	return nil
+}
+
+func exchangeSummary(ex *client.Exchange) string {
+	request := fmt.Sprintf("%s %s", ex.Request.Method, ex.Request.URL)
+	switch {
+	case ex.Response != nil:
+		return fmt.Sprintf("%s -> %d %s (%s)", request, ex.Response.Status, http.StatusText(ex.Response.Status), ex.Duration.Round(time.Microsecond*100))
+	case ex.Error != "":
+		return fmt.Sprintf("%s -> error: %s", request, ex.Error)
+	default:
+		return fmt.Sprintf("%s -> pending", request)
+	}
+}
@@ -0,0 +1,305 @@
+// Package har builds HTTP Archive (HAR 1.2) logs from captured HTTP
+// exchanges, see http://www.softwareishard.com/blog/har-12-spec/.
+package har
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jkuri/bore/internal/version"
+)
+
+// Redacted replaces values of redacted headers.
+const Redacted = "[redacted]"
+
+// DefaultRedact lists headers whose values are redacted unless other
+// rules are given.
+var DefaultRedact = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// HAR is the root of an HTTP Archive.
+type HAR struct {
+	Log Log `json:"log"`
+}
+
+// Log holds the archived entries.
+type Log struct {
+	Version string  `json:"version"`
+	Creator Creator `json:"creator"`
+	Entries []Entry `json:"entries"`
+}
+
+// Creator describes the application that created the log.
+type Creator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Entry is a single request with its response.
+type Entry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	Time            float64   `json:"time"` // milliseconds
+	Request         Request   `json:"request"`
+	Response        Response  `json:"response"`
+	Cache           struct{}  `json:"cache"`
+	Timings         Timings   `json:"timings"`
+	Comment         string    `json:"comment,omitempty"`
+	Error           string    `json:"_error,omitempty"` // set if no response was received
+}
+
+// Request is the request part of an Entry.
+type Request struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []Cookie    `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	QueryString []NameValue `json:"queryString"`
+	PostData    *PostData   `json:"postData,omitempty"`
+	HeadersSize int64       `json:"headersSize"`
+	BodySize    int64       `json:"bodySize"`
+}
+
+// Response is the response part of an Entry.
+type Response struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []Cookie    `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	Content     Content     `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int64       `json:"headersSize"`
+	BodySize    int64       `json:"bodySize"`
+}
+
+// NameValue is a header or query string parameter.
+type NameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Cookie is a cookie sent with the request or set by the response.
+type Cookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Path     string     `json:"path,omitempty"`
+	Domain   string     `json:"domain,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	HTTPOnly bool       `json:"httpOnly,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+}
+
+// PostData is the request body.
+type PostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"` // base64 for binary bodies
+	Comment  string `json:"comment,omitempty"`
+}
+
+// Content is the response body.
+type Content struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// Timings splits Entry.Time into phases. Only the total is measured, so
+// it is all reported as waiting for the response.
+type Timings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// Exchange is a captured request and response to convert into an Entry.
+// Bodies may be cut short, in which case the full sizes are given by
+// RequestBodySize and ResponseBodySize.
+type Exchange struct {
+	Started  time.Time
+	Duration time.Duration
+
+	Method        string
+	URL           string // absolute URL
+	Proto         string
+	RequestHeader http.Header
+	RequestBody   []byte
+
+	RequestBodySize int64
+
+	Status         int // zero if no response was received
+	ResponseProto  string
+	ResponseHeader http.Header
+	ResponseBody   []byte
+
+	ResponseBodySize int64
+
+	Error string
+}
+
+// New returns an empty log.
+func New() *HAR {
+	return &HAR{Log: Log{
+		Version: "1.2",
+		Creator: Creator{Name: "bore", Version: version.Version},
+		Entries: []Entry{},
+	}}
+}
+
+// NewEntry converts ex into an Entry. Values of headers named in
+// redact, compared case-insensitively, are replaced with Redacted.
+func NewEntry(ex Exchange, redact []string) Entry {
+	ms := float64(ex.Duration) / float64(time.Millisecond)
+	e := Entry{
+		StartedDateTime: ex.Started,
+		Time:            ms,
+		Timings:         Timings{Wait: ms},
+		Error:           ex.Error,
+		Request: Request{
+			Method:      ex.Method,
+			URL:         ex.URL,
+			HTTPVersion: ex.Proto,
+			Cookies:     []Cookie{},
+			Headers:     headers(ex.RequestHeader, redact),
+			QueryString: []NameValue{},
+			HeadersSize: -1,
+			BodySize:    ex.RequestBodySize,
+		},
+		Response: Response{
+			Status:      ex.Status,
+			StatusText:  http.StatusText(ex.Status),
+			HTTPVersion: ex.ResponseProto,
+			Cookies:     []Cookie{},
+			Headers:     headers(ex.ResponseHeader, redact),
+			RedirectURL: ex.ResponseHeader.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    ex.ResponseBodySize,
+		},
+	}
+
+	if u, err := url.Parse(ex.URL); err == nil {
+		for name, values := range u.Query() {
+			for _, v := range values {
+				e.Request.QueryString = append(e.Request.QueryString, NameValue{name, v})
+			}
+		}
+		sort.SliceStable(e.Request.QueryString, func(i, j int) bool {
+			return e.Request.QueryString[i].Name < e.Request.QueryString[j].Name
+		})
+	}
+
+	if !redacted("Cookie", redact) {
+		r := &http.Request{Header: http.Header{"Cookie": ex.RequestHeader.Values("Cookie")}}
+		for _, c := range r.Cookies() {
+			e.Request.Cookies = append(e.Request.Cookies, Cookie{Name: c.Name, Value: c.Value})
+		}
+	}
+	if !redacted("Set-Cookie", redact) {
+		r := &http.Response{Header: http.Header{"Set-Cookie": ex.ResponseHeader.Values("Set-Cookie")}}
+		for _, c := range r.Cookies() {
+			cookie := Cookie{
+				Name:     c.Name,
+				Value:    c.Value,
+				Path:     c.Path,
+				Domain:   c.Domain,
+				HTTPOnly: c.HttpOnly,
+				Secure:   c.Secure,
+			}
+			if !c.Expires.IsZero() {
+				cookie.Expires = &c.Expires
+			}
+			e.Response.Cookies = append(e.Response.Cookies, cookie)
+		}
+	}
+
+	if ex.RequestBodySize > 0 {
+		text, encoding := encodeBody(ex.RequestBody)
+		e.Request.PostData = &PostData{
+			MimeType: ex.RequestHeader.Get("Content-Type"),
+			Text:     text,
+			Encoding: encoding,
+			Comment:  truncated(ex.RequestBody, ex.RequestBodySize),
+		}
+	}
+
+	if ex.Status == 0 {
+		e.Response.HTTPVersion = ex.Proto
+		e.Response.BodySize = -1
+		e.Response.Content.Size = -1
+		return e
+	}
+
+	text, encoding := encodeBody(ex.ResponseBody)
+	e.Response.Content = Content{
+		Size:     ex.ResponseBodySize,
+		MimeType: ex.ResponseHeader.Get("Content-Type"),
+		Text:     text,
+		Encoding: encoding,
+		Comment:  truncated(ex.ResponseBody, ex.ResponseBodySize),
+	}
+	return e
+}
+
+// ParseRedact parses comma separated header names. An empty string or
+// "none" disables redaction.
+func ParseRedact(s string) []string {
+	names := []string{}
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" && !strings.EqualFold(name, "none") {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	return names
+}
+
+// headers returns h sorted by name with redacted values replaced.
+func headers(h http.Header, redact []string) []NameValue {
+	list := []NameValue{}
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range h[name] {
+			if redacted(name, redact) {
+				v = Redacted
+			}
+			list = append(list, NameValue{name, v})
+		}
+	}
+	return list
+}
+
+func redacted(name string, redact []string) bool {
+	for _, r := range redact {
+		if strings.EqualFold(name, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeBody returns body as text, or base64 encoded if it is not
+// valid UTF-8.
+func encodeBody(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func truncated(body []byte, size int64) string {
+	if int64(len(body)) >= size {
+		return ""
+	}
+	return fmt.Sprintf("body truncated to the first %d of %d bytes", len(body), size)
+}
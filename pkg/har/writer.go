@@ -0,0 +1,73 @@
+package har
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// logEnd closes the entries array and the log.
+var logEnd = []byte("\n]}}\n")
+
+// Writer streams entries to a HAR file. The file is a complete log after
+// every write, so it can be opened while capturing is still going on.
+type Writer struct {
+	mu      sync.Mutex
+	file    *os.File
+	offset  int64 // where logEnd starts
+	entries int
+}
+
+// Create creates or truncates the file at path and writes an empty log.
+func Create(path string) (*Writer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := json.Marshal(New())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// Cut the log after the opening bracket of the empty entries array.
+	head = head[:bytes.LastIndex(head, []byte("[]"))+1]
+
+	w := &Writer{file: file, offset: int64(len(head))}
+	if _, err := file.Write(append(head, logEnd...)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write appends e to the log.
+func (w *Writer) Write(e Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	sep := []byte(",\n")
+	if w.entries == 0 {
+		sep = []byte("\n")
+	}
+	buf := append(append(sep, data...), logEnd...)
+	if _, err := w.file.WriteAt(buf, w.offset); err != nil {
+		return err
+	}
+	w.offset += int64(len(buf) - len(logEnd))
+	w.entries++
+	return nil
+}
+
+// Close closes the file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
@@ -0,0 +1,51 @@
+// Package udpframe frames UDP datagrams on forwarded-udp channels, over
+// which client and server relay the datagrams of a UDP tunnel.
+package udpframe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// MaxFrame bounds frames read from forwarded-udp channels.
+const MaxFrame = 1 << 17
+
+// Datagram is a datagram framed on forwarded-udp channels. Addr and
+// Port are the peer the datagram came from or is sent to.
+type Datagram struct {
+	Addr string
+	Port uint32
+	Data []byte `ssh:"rest"`
+}
+
+// Write writes d to w as a frame prefixed with its length.
+func Write(w io.Writer, d Datagram) error {
+	payload := ssh.Marshal(&d)
+	frame := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[4:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+// Read reads a frame written by Write.
+func Read(r io.Reader) (Datagram, error) {
+	var d Datagram
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return d, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > MaxFrame {
+		return d, fmt.Errorf("UDP frame of %d bytes is too large", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return d, err
+	}
+	err := ssh.Unmarshal(payload, &d)
+	return d, err
+}
@@ -0,0 +1,392 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// acmeAccountKey is the cache key of the ACME account key. It is the
+	// same key autocert uses, so both share the account.
+	acmeAccountKey = "acme_account+key"
+	// acmeRenewBefore is how long before expiry the wildcard certificate
+	// is renewed.
+	acmeRenewBefore = 30 * 24 * time.Hour
+	// acmeCheckInterval is how often the wildcard certificate expiry is
+	// checked.
+	acmeCheckInterval = 12 * time.Hour
+)
+
+// DNSProvider publishes TXT records for ACME DNS-01 challenges.
+// Implementations must add the record rather than replace existing
+// records with the same name.
+type DNSProvider interface {
+	// Present creates TXT record fqdn with given value.
+	Present(ctx context.Context, fqdn, value string) error
+	// CleanUp removes the record created by Present.
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// execDNSProvider runs a command to manage DNS records. The command is
+// called with "present" or "cleanup" followed by the record name and
+// value, e.g. `hook present _acme-challenge.bore.digital. <value>`.
+type execDNSProvider struct {
+	command string
+}
+
+func (p *execDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+func (p *execDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
+
+func (p *execDNSProvider) run(ctx context.Context, args ...string) error {
+	out, err := exec.CommandContext(ctx, p.command, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", p.command, args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// acmeManager obtains and renews certificates from an ACME CA. With a
+// DNS provider a single wildcard certificate for the domain is obtained
+// via DNS-01, otherwise autocert obtains a certificate for every host
+// on first request via TLS-ALPN-01 or HTTP-01.
+type acmeManager struct {
+	mu        sync.Mutex
+	opts      ACME
+	domain    string
+	client    *acme.Client
+	cache     autocert.DirCache
+	provider  DNSProvider
+	autocert  *autocert.Manager
+	wildcard  *tls.Certificate
+	hostAllow func(host string) bool
+	logger    *zap.SugaredLogger
+}
+
+func newACMEManager(opts ACME, domain string, hostAllow func(host string) bool, logger *zap.SugaredLogger) (*acmeManager, error) {
+	m := &acmeManager{
+		opts:      opts,
+		domain:    strings.ToLower(domain),
+		cache:     autocert.DirCache(opts.Cache),
+		provider:  opts.Provider,
+		hostAllow: hostAllow,
+		logger:    logger,
+	}
+	if m.provider == nil && opts.DNSCommand != "" {
+		m.provider = &execDNSProvider{command: opts.DNSCommand}
+	}
+
+	httpClient := http.DefaultClient
+	if opts.CARoots != "" {
+		data, err := os.ReadFile(opts.CARoots)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CARoots)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		httpClient = &http.Client{Transport: transport}
+	}
+
+	m.client = &acme.Client{
+		DirectoryURL: opts.Directory,
+		HTTPClient:   httpClient,
+	}
+	m.autocert = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      m.cache,
+		HostPolicy: m.hostPolicy,
+		Client:     m.client,
+		Email:      opts.Email,
+	}
+
+	return m, nil
+}
+
+// run obtains the wildcard certificate, if a DNS provider is set, and
+// renews it until ctx is cancelled. It returns after the first attempt
+// to get the certificate completes.
+func (m *acmeManager) run(ctx context.Context) error {
+	key, err := m.accountKey(ctx)
+	if err != nil {
+		return err
+	}
+	m.client.Key = key
+
+	if m.provider == nil {
+		return nil
+	}
+
+	if err := m.renew(ctx); err != nil {
+		return err
+	}
+
+	go func() {
+		t := time.NewTicker(acmeCheckInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if err := m.renew(ctx); err != nil {
+					m.logger.Errorf("error renewing certificate for *.%s: %v", m.domain, err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (m *acmeManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if m.provider != nil && m.coveredByWildcard(name) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.wildcard == nil {
+			return nil, fmt.Errorf("no certificate for *.%s", m.domain)
+		}
+		return m.wildcard, nil
+	}
+	return m.autocert.GetCertificate(hello)
+}
+
+// HTTPHandler serves HTTP-01 challenges and passes other requests to
+// fallback.
+func (m *acmeManager) HTTPHandler(fallback http.Handler) http.Handler {
+	return m.autocert.HTTPHandler(fallback)
+}
+
+// coveredByWildcard reports whether name is the domain or a direct
+// subdomain of it.
+func (m *acmeManager) coveredByWildcard(name string) bool {
+	if name == m.domain {
+		return true
+	}
+	label, ok := strings.CutSuffix(name, "."+m.domain)
+	return ok && label != "" && !strings.Contains(label, ".")
+}
+
+// hostPolicy allows autocert to request certificates for the domain and
+// for hosts accepted by hostAllow.
+func (m *acmeManager) hostPolicy(ctx context.Context, host string) error {
+	if host == m.domain || (m.hostAllow != nil && m.hostAllow(host)) {
+		return nil
+	}
+	return fmt.Errorf("acme: host %q not allowed", host)
+}
+
+// renew loads the wildcard certificate from cache and obtains a new one
+// if it is missing or about to expire.
+func (m *acmeManager) renew(ctx context.Context) error {
+	name := "*." + m.domain
+
+	m.mu.Lock()
+	cert := m.wildcard
+	m.mu.Unlock()
+
+	if cert == nil {
+		data, err := m.cache.Get(ctx, name)
+		if err != nil && err != autocert.ErrCacheMiss {
+			return err
+		}
+		if err == nil {
+			if c, err := tls.X509KeyPair(data, data); err == nil {
+				cert = &c
+			} else {
+				m.logger.Errorf("ignoring invalid cached certificate for %s: %v", name, err)
+			}
+		}
+	}
+
+	if cert != nil && time.Until(cert.Leaf.NotAfter) > acmeRenewBefore {
+		m.mu.Lock()
+		m.wildcard = cert
+		m.mu.Unlock()
+		return nil
+	}
+
+	m.logger.Infof("obtaining certificate for %s", name)
+	data, err := m.obtainWildcard(ctx)
+	if err != nil {
+		return err
+	}
+	c, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return err
+	}
+	if err := m.cache.Put(ctx, name, data); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.wildcard = &c
+	m.mu.Unlock()
+	m.logger.Infof("obtained certificate for %s valid until %s", name, c.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// obtainWildcard orders certificate for the domain and all its direct
+// subdomains, and returns it PEM encoded together with its key.
+func (m *acmeManager) obtainWildcard(ctx context.Context) ([]byte, error) {
+	if _, err := m.client.Register(ctx, &acme.Account{Contact: m.contact()}, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, err
+	}
+
+	ids := acme.DomainIDs("*."+m.domain, m.domain)
+	order, err := m.client.AuthorizeOrder(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, url := range order.AuthzURLs {
+		if err := m.authorizeDNS(ctx, url); err != nil {
+			return nil, err
+		}
+	}
+
+	order, err = m.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(crand.Reader, &x509.CertificateRequest{
+		DNSNames: []string{"*." + m.domain, m.domain},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for _, b := range der {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+	return data, nil
+}
+
+// authorizeDNS fulfills DNS-01 challenge of the authorization. The
+// wildcard and the bare domain share the record name, so authorizations
+// are completed one at a time.
+func (m *acmeManager) authorizeDNS(ctx context.Context, url string) error {
+	authz, err := m.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no dns-01 challenge offered for %s", authz.Identifier.Value)
+	}
+
+	value, err := m.client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	fqdn := "_acme-challenge." + authz.Identifier.Value + "."
+	if err := m.provider.Present(ctx, fqdn, value); err != nil {
+		return err
+	}
+	defer func() {
+		if err := m.provider.CleanUp(ctx, fqdn, value); err != nil {
+			m.logger.Errorf("error cleaning up %s: %v", fqdn, err)
+		}
+	}()
+
+	if m.opts.PropagationDelay > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(m.opts.PropagationDelay):
+		}
+	}
+
+	if _, err := m.client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = m.client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// accountKey loads the ACME account key from cache or generates and
+// stores a new one.
+func (m *acmeManager) accountKey(ctx context.Context) (crypto.Signer, error) {
+	data, err := m.cache.Get(ctx, acmeAccountKey)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "EC PRIVATE KEY" {
+			return nil, errors.New("invalid cached ACME account key")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if err != autocert.ErrCacheMiss {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.cache.Put(ctx, acmeAccountKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (m *acmeManager) contact() []string {
+	if m.opts.Email == "" {
+		return nil
+	}
+	return []string{"mailto:" + m.opts.Email}
+}
@@ -0,0 +1,535 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+)
+
+// acmeStub is an ACME CA implementing the parts of RFC 8555 needed to
+// obtain a certificate over DNS-01. TXT records are looked up with
+// lookupTXT. JWS signatures are not verified.
+type acmeStub struct {
+	*httptest.Server
+	lookupTXT func(fqdn string) []string
+	caKey     *ecdsa.PrivateKey
+	caCert    *x509.Certificate
+
+	mu       sync.Mutex
+	accounts map[string]string // account URL to key thumbprint
+	orders   []*stubOrder
+	authzs   []*stubAuthz
+	certs    [][]byte // PEM chains
+}
+
+type stubOrder struct {
+	Status         string         `json:"status"`
+	Identifiers    []acme.AuthzID `json:"identifiers"`
+	Authorizations []string       `json:"authorizations"`
+	Finalize       string         `json:"finalize"`
+	Certificate    string         `json:"certificate,omitempty"`
+	authzs         []*stubAuthz
+}
+
+type stubAuthz struct {
+	Identifier acme.AuthzID    `json:"identifier"`
+	Status     string          `json:"status"`
+	Wildcard   bool            `json:"wildcard,omitempty"`
+	Challenges []stubChallenge `json:"challenges"`
+	account    string
+}
+
+type stubChallenge struct {
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Status string `json:"status"`
+}
+
+func newACMEStub(t *testing.T, lookupTXT func(fqdn string) []string) *acmeStub {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ACME stub CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &acmeStub{
+		lookupTXT: lookupTXT,
+		caKey:     caKey,
+		caCert:    caCert,
+		accounts:  make(map[string]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /directory", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"newNonce":   s.URL + "/nonce",
+			"newAccount": s.URL + "/account",
+			"newOrder":   s.URL + "/order",
+			"revokeCert": s.URL + "/revoke",
+			"keyChange":  s.URL + "/key-change",
+			"meta":       map[string]string{"termsOfService": s.URL + "/terms"},
+		})
+	})
+	mux.HandleFunc("HEAD /nonce", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("POST /account", s.newAccount)
+	mux.HandleFunc("POST /order", s.newOrder)
+	mux.HandleFunc("POST /order/{n}", s.getOrder)
+	mux.HandleFunc("POST /authz/{n}", s.getAuthz)
+	mux.HandleFunc("POST /chal/{n}/{i}", s.accept)
+	mux.HandleFunc("POST /finalize/{n}", s.finalize)
+	mux.HandleFunc("POST /cert/{n}", s.getCert)
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", randToken())
+		w.Header().Set("Cache-Control", "no-store")
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// rootsFile writes certificate of the stub's TLS server to a PEM file,
+// to be trusted with ACME.CARoots.
+func (s *acmeStub) rootsFile(t *testing.T) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "roots.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	if err := os.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func (s *acmeStub) orderCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.orders)
+}
+
+// readJWS decodes the JWS request body into payload and returns its
+// protected header.
+func readJWS(r *http.Request, payload any) (header struct {
+	JWK json.RawMessage `json:"jwk"`
+	KID string          `json:"kid"`
+}, err error) {
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}
+	if err = json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return header, err
+	}
+	data, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return header, err
+	}
+	if err = json.Unmarshal(data, &header); err != nil {
+		return header, err
+	}
+	if data, err = base64.RawURLEncoding.DecodeString(jws.Payload); err != nil || payload == nil {
+		return header, err
+	}
+	return header, json.Unmarshal(data, payload)
+}
+
+// account returns URL of the account that signed the request.
+func (s *acmeStub) account(w http.ResponseWriter, r *http.Request, payload any) (string, bool) {
+	header, err := readJWS(r, payload)
+	if err != nil {
+		acmeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+		return "", false
+	}
+	s.mu.Lock()
+	_, ok := s.accounts[header.KID]
+	s.mu.Unlock()
+	if !ok {
+		acmeProblem(w, http.StatusUnauthorized, "accountDoesNotExist", "unknown account "+header.KID)
+		return "", false
+	}
+	return header.KID, true
+}
+
+func (s *acmeStub) newAccount(w http.ResponseWriter, r *http.Request) {
+	header, err := readJWS(r, &struct{}{})
+	if err != nil {
+		acmeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	var jwk struct{ X, Y string }
+	if err := json.Unmarshal(header.JWK, &jwk); err != nil {
+		acmeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+	y, _ := base64.RawURLEncoding.DecodeString(jwk.Y)
+	thumbprint, err := acme.JWKThumbprint(&ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)})
+	if err != nil {
+		acmeProblem(w, http.StatusBadRequest, "badPublicKey", err.Error())
+		return
+	}
+
+	url := s.URL + "/acct/" + thumbprint
+	s.mu.Lock()
+	_, exists := s.accounts[url]
+	s.accounts[url] = thumbprint
+	s.mu.Unlock()
+
+	status := http.StatusCreated
+	if exists {
+		status = http.StatusOK
+	}
+	w.Header().Set("Location", url)
+	writeJSON(w, status, map[string]string{"status": "valid"})
+}
+
+func (s *acmeStub) newOrder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Identifiers []acme.AuthzID `json:"identifiers"`
+	}
+	account, ok := s.account(w, r, &req)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	n := len(s.orders)
+	order := &stubOrder{
+		Status:      acme.StatusPending,
+		Identifiers: req.Identifiers,
+		Finalize:    fmt.Sprintf("%s/finalize/%d", s.URL, n),
+	}
+	for _, id := range req.Identifiers {
+		authz := &stubAuthz{
+			Identifier: acme.AuthzID{Type: id.Type, Value: strings.TrimPrefix(id.Value, "*.")},
+			Status:     acme.StatusPending,
+			Wildcard:   strings.HasPrefix(id.Value, "*."),
+			account:    account,
+		}
+		i := len(s.authzs)
+		authz.Challenges = []stubChallenge{{"dns-01", fmt.Sprintf("%s/chal/%d/0", s.URL, i), randToken(), acme.StatusPending}}
+		s.authzs = append(s.authzs, authz)
+		order.authzs = append(order.authzs, authz)
+		order.Authorizations = append(order.Authorizations, fmt.Sprintf("%s/authz/%d", s.URL, i))
+	}
+	s.orders = append(s.orders, order)
+	s.mu.Unlock()
+
+	s.writeOrder(w, http.StatusCreated, n)
+}
+
+func (s *acmeStub) writeOrder(w http.ResponseWriter, status, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	order := s.orders[n]
+	if order.Status == acme.StatusPending && !slices.ContainsFunc(order.authzs, func(a *stubAuthz) bool { return a.Status != acme.StatusValid }) {
+		order.Status = acme.StatusReady
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/order/%d", s.URL, n))
+	writeJSON(w, status, order)
+}
+
+// index returns the path value name as index into a list of length n.
+func index(w http.ResponseWriter, r *http.Request, name string, n int) (int, bool) {
+	var i int
+	if _, err := fmt.Sscan(r.PathValue(name), &i); err != nil || i < 0 || i >= n {
+		acmeProblem(w, http.StatusNotFound, "malformed", "not found")
+		return 0, false
+	}
+	return i, true
+}
+
+func (s *acmeStub) getOrder(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.account(w, r, nil); !ok {
+		return
+	}
+	if n, ok := index(w, r, "n", s.orderCount()); ok {
+		s.writeOrder(w, http.StatusOK, n)
+	}
+}
+
+func (s *acmeStub) getAuthz(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.account(w, r, nil); !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n, ok := index(w, r, "n", len(s.authzs)); ok {
+		writeJSON(w, http.StatusOK, s.authzs[n])
+	}
+}
+
+// accept validates the dns-01 challenge right away.
+func (s *acmeStub) accept(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.account(w, r, &struct{}{}); !ok {
+		return
+	}
+	s.mu.Lock()
+	n, ok := index(w, r, "n", len(s.authzs))
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	authz := s.authzs[n]
+	chal := &authz.Challenges[0]
+	sum := sha256.Sum256([]byte(chal.Token + "." + s.accounts[authz.account]))
+	want := base64.RawURLEncoding.EncodeToString(sum[:])
+	s.mu.Unlock()
+
+	// The wildcard and the bare domain share the record, so it may hold
+	// values of both challenges.
+	status := acme.StatusInvalid
+	if slices.Contains(s.lookupTXT("_acme-challenge."+authz.Identifier.Value+"."), want) {
+		status = acme.StatusValid
+	}
+
+	s.mu.Lock()
+	chal.Status = status
+	authz.Status = status
+	writeJSON(w, http.StatusOK, chal)
+	s.mu.Unlock()
+}
+
+func (s *acmeStub) finalize(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	if _, ok := s.account(w, r, &req); !ok {
+		return
+	}
+	n, ok := index(w, r, "n", s.orderCount())
+	if !ok {
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	if err != nil {
+		acmeProblem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		acmeProblem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	order := s.orders[n]
+	var names []string
+	for _, id := range order.Identifiers {
+		names = append(names, id.Value)
+	}
+	if order.Status != acme.StatusReady {
+		s.mu.Unlock()
+		acmeProblem(w, http.StatusForbidden, "orderNotReady", "order is "+order.Status)
+		return
+	}
+	if !slices.Equal(slices.Sorted(slices.Values(csr.DNSNames)), slices.Sorted(slices.Values(names))) {
+		s.mu.Unlock()
+		acmeProblem(w, http.StatusBadRequest, "badCSR", "CSR names don't match the order")
+		return
+	}
+	s.mu.Unlock()
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(n) + 100),
+		Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, tmpl, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		acmeProblem(w, http.StatusInternalServerError, "serverInternal", err.Error())
+		return
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})...)
+
+	s.mu.Lock()
+	order.Status = acme.StatusValid
+	order.Certificate = fmt.Sprintf("%s/cert/%d", s.URL, len(s.certs))
+	s.certs = append(s.certs, chain)
+	s.mu.Unlock()
+
+	s.writeOrder(w, http.StatusOK, n)
+}
+
+func (s *acmeStub) getCert(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.account(w, r, nil); !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n, ok := index(w, r, "n", len(s.certs)); ok {
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(s.certs[n])
+	}
+}
+
+func acmeProblem(w http.ResponseWriter, status int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"type": "urn:ietf:params:acme:error:" + typ, "detail": detail})
+}
+
+// fakeDNS keeps TXT records in memory. If corrupt is set, it publishes
+// wrong values.
+type fakeDNS struct {
+	mu      sync.Mutex
+	records map[string][]string
+	corrupt bool
+}
+
+func (d *fakeDNS) Present(ctx context.Context, fqdn, value string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.records == nil {
+		d.records = make(map[string][]string)
+	}
+	if d.corrupt {
+		value = "x" + value
+	}
+	d.records[fqdn] = append(d.records[fqdn], value)
+	return nil
+}
+
+func (d *fakeDNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.corrupt {
+		value = "x" + value
+	}
+	d.records[fqdn] = slices.DeleteFunc(d.records[fqdn], func(v string) bool { return v == value })
+	if len(d.records[fqdn]) == 0 {
+		delete(d.records, fqdn)
+	}
+	return nil
+}
+
+func (d *fakeDNS) lookup(fqdn string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Clone(d.records[fqdn])
+}
+
+func newTestACMEManager(t *testing.T, stub *acmeStub, dns *fakeDNS, cache string) *acmeManager {
+	t.Helper()
+	m, err := newACMEManager(ACME{
+		Enabled:   true,
+		Email:     "admin@example.test",
+		Directory: stub.URL + "/directory",
+		CARoots:   stub.rootsFile(t),
+		Cache:     cache,
+		Provider:  dns,
+	}, "Example.test", nil, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestACMEWildcardCertificate(t *testing.T) {
+	dns := &fakeDNS{}
+	stub := newACMEStub(t, dns.lookup)
+	cache := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newTestACMEManager(t, stub, dns, cache)
+	if err := m.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(stub.caCert)
+	for _, name := range []string{"example.test", "app.example.test", "APP.example.test."} {
+		cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: strings.TrimSuffix(name, "."), Roots: roots}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	if records := dns.lookup("_acme-challenge.example.test."); len(records) != 0 {
+		t.Fatalf("challenge records left behind: %v", records)
+	}
+	for _, name := range []string{acmeAccountKey, "*.example.test"} {
+		if _, err := os.Stat(filepath.Join(cache, name)); err != nil {
+			t.Fatalf("%s not cached: %v", name, err)
+		}
+	}
+
+	// A restarted server uses the cached certificate.
+	first, _ := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "app.example.test"})
+	m = newTestACMEManager(t, stub, dns, cache)
+	if err := m.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "app.example.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf.SerialNumber.Cmp(first.Leaf.SerialNumber) != 0 {
+		t.Fatalf("got certificate %v, want cached %v", cert.Leaf.SerialNumber, first.Leaf.SerialNumber)
+	}
+	if n := stub.orderCount(); n != 1 {
+		t.Fatalf("%d orders placed, want 1", n)
+	}
+}
+
+func TestACMEFailedChallenge(t *testing.T) {
+	dns := &fakeDNS{corrupt: true}
+	stub := newACMEStub(t, dns.lookup)
+	cache := t.TempDir()
+
+	m := newTestACMEManager(t, stub, dns, cache)
+	if err := m.run(context.Background()); err == nil {
+		t.Fatal("certificate obtained with wrong challenge record")
+	}
+	if _, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "app.example.test"}); err == nil {
+		t.Fatal("certificate served after failed order")
+	}
+	if _, err := os.Stat(filepath.Join(cache, "*.example.test")); !os.IsNotExist(err) {
+		t.Fatalf("certificate cached after failed order: %v", err)
+	}
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bans are owners and addresses banned through the admin API. They are
+// kept in memory only, permanent bans belong to authorizedkeys and
+// denyips in the config file.
+type bans struct {
+	mu     sync.Mutex
+	owners map[string]time.Time
+	ips    map[netip.Prefix]time.Time
+}
+
+func newBans() *bans {
+	return &bans{
+		owners: make(map[string]time.Time),
+		ips:    make(map[netip.Prefix]time.Time),
+	}
+}
+
+func (b *bans) owner(owner string) bool {
+	if owner == "" {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.owners[owner]
+	return ok
+}
+
+func (b *bans) ip(addr netip.Addr) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for p := range b.ips {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// banned reports whether the client's owner or address is banned.
+func (s *SSHServer) banned(c *client) bool {
+	return s.bans.owner(c.owner()) || s.bans.ip(connAddr(c.tcpConn))
+}
+
+// disconnect closes the client connection with all its tunnels. The
+// tunnels are not held for resume.
+func (s *SSHServer) disconnect(c *client) {
+	c.mu.Lock()
+	tunnels := make([]*tunnel, 0, len(c.tunnels))
+	for _, t := range c.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	c.mu.Unlock()
+
+	// Closing the tunnels first drops their resume tokens, so they
+	// are not held once the connection closes.
+	for _, t := range tunnels {
+		s.closeTunnel(t)
+	}
+	c.sshConn.Close()
+}
+
+// disconnectBanned disconnects all clients that are banned.
+func (s *SSHServer) disconnectBanned() {
+	s.mu.Lock()
+	clients := make(map[*client]bool)
+	for _, t := range s.tunnels {
+		clients[t.client] = true
+	}
+	s.mu.Unlock()
+
+	for c := range clients {
+		if s.banned(c) {
+			s.logger.Infof("[%s] disconnecting banned client %s", c.id, c.owner())
+			s.disconnect(c)
+		}
+	}
+}
+
+type adminTunnel struct {
+	TunnelMetrics
+	Bind       string   `json:"bind"`
+	ClientAddr string   `json:"clientAddr"`
+	Domains    []string `json:"domains,omitempty"`
+	Auth       bool     `json:"auth"`
+	OIDC       bool     `json:"oidc"`
+	IPFilter   bool     `json:"ipFilter"`
+	UDP        bool     `json:"udp,omitempty"`
+}
+
+type adminBan struct {
+	Owner   string    `json:"owner,omitempty"`
+	IP      string    `json:"ip,omitempty"`
+	Created time.Time `json:"created,omitempty"`
+}
+
+// runAdmin starts the admin API server. With Admin.ClientCA set it
+// serves TLS and requires client certificates signed by the CA.
+func (s *BoreServer) runAdmin() error {
+	handler := s.adminHandler()
+	if s.opts.Admin.ClientCA == "" {
+		return s.adminServer.Run(s.opts.Admin.Addr, handler)
+	}
+
+	data, err := os.ReadFile(s.opts.Admin.ClientCA)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates found in %s", s.opts.Admin.ClientCA)
+	}
+	cert := newCertificate(s.opts.Admin.TLSCert, s.opts.Admin.TLSKey, s.httpServer.logger)
+	if err := cert.load(); err != nil {
+		return err
+	}
+
+	return s.adminServer.RunTLS(s.opts.Admin.Addr, handler, &tls.Config{
+		GetCertificate: cert.GetCertificate,
+		ClientCAs:      pool,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		MinVersion:     tls.VersionTLS12,
+	})
+}
+
+func (s *BoreServer) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/admin/tunnels", s.adminListTunnels)
+	mux.HandleFunc("GET /api/admin/tunnels/{id}", s.adminGetTunnel)
+	mux.HandleFunc("DELETE /api/admin/tunnels/{id}", s.adminKillTunnel)
+	mux.HandleFunc("GET /api/admin/tunnels/{id}/har", s.adminCaptureHAR)
+	mux.HandleFunc("GET /api/admin/bans", s.adminListBans)
+	mux.HandleFunc("POST /api/admin/bans", s.adminAddBan)
+	mux.HandleFunc("DELETE /api/admin/bans", s.adminRemoveBan)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := s.opts.Admin.Token; token != "" {
+			got, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="bore admin"`)
+				writeJSONError(w, http.StatusUnauthorized, "invalid admin token")
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *BoreServer) adminListTunnels(w http.ResponseWriter, r *http.Request) {
+	s.sshServer.mu.Lock()
+	tunnels := make([]*tunnel, 0, len(s.sshServer.tunnels))
+	for _, t := range s.sshServer.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	s.sshServer.mu.Unlock()
+
+	list := make([]adminTunnel, 0, len(tunnels))
+	for _, t := range tunnels {
+		list = append(list, s.adminTunnel(t))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *BoreServer) adminGetTunnel(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.lookupTunnel(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.adminTunnel(t))
+}
+
+// adminKillTunnel disconnects the client owning the tunnel, which
+// closes all tunnels opened over the same connection.
+func (s *BoreServer) adminKillTunnel(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.lookupTunnel(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+	s.httpServer.logger.Infof("[%s] disconnecting client %s on admin request", t.id, t.client.owner())
+	s.sshServer.disconnect(t.client)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *BoreServer) adminListBans(w http.ResponseWriter, r *http.Request) {
+	b := s.sshServer.bans
+	b.mu.Lock()
+	list := make([]adminBan, 0, len(b.owners)+len(b.ips))
+	for owner, created := range b.owners {
+		list = append(list, adminBan{Owner: owner, Created: created})
+	}
+	for p, created := range b.ips {
+		list = append(list, adminBan{IP: p.String(), Created: created})
+	}
+	b.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	writeJSON(w, http.StatusOK, list)
+}
+
+// adminAddBan bans an owner (key fingerprint, token:<name> or
+// cert:<key id>) or an address and disconnects matching clients.
+func (s *BoreServer) adminAddBan(w http.ResponseWriter, r *http.Request) {
+	ban, prefix, err := decodeBan(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	b := s.sshServer.bans
+	b.mu.Lock()
+	now := time.Now()
+	if ban.Owner != "" {
+		b.owners[ban.Owner] = now
+	}
+	if prefix.IsValid() {
+		b.ips[prefix] = now
+	}
+	b.mu.Unlock()
+
+	if ban.Owner != "" {
+		s.httpServer.logger.Infof("banned %s on admin request", ban.Owner)
+	}
+	if prefix.IsValid() {
+		s.httpServer.logger.Infof("banned %s on admin request", prefix)
+	}
+	s.sshServer.disconnectBanned()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *BoreServer) adminRemoveBan(w http.ResponseWriter, r *http.Request) {
+	ban, prefix, err := decodeBan(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	b := s.sshServer.bans
+	b.mu.Lock()
+	delete(b.owners, ban.Owner)
+	delete(b.ips, prefix)
+	b.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decodeBan(r *http.Request) (adminBan, netip.Prefix, error) {
+	var ban adminBan
+	if err := json.NewDecoder(r.Body).Decode(&ban); err != nil {
+		return ban, netip.Prefix{}, fmt.Errorf("invalid request body: %v", err)
+	}
+	if ban.Owner == "" && ban.IP == "" {
+		return ban, netip.Prefix{}, fmt.Errorf("owner or ip must be set")
+	}
+
+	var prefix netip.Prefix
+	if ban.IP != "" {
+		prefixes, err := parsePrefixes([]string{ban.IP})
+		if err != nil {
+			return ban, netip.Prefix{}, err
+		}
+		prefix = prefixes[0]
+	}
+	return ban, prefix, nil
+}
+
+func (s *BoreServer) lookupTunnel(id string) (*tunnel, bool) {
+	s.sshServer.mu.Lock()
+	defer s.sshServer.mu.Unlock()
+	t, ok := s.sshServer.tunnels[id]
+	return t, ok
+}
+
+func (s *BoreServer) adminTunnel(t *tunnel) adminTunnel {
+	metrics, ok := s.metricsHub.tunnelMetric(t.id)
+	if !ok {
+		metrics = TunnelMetrics{
+			ID:     t.id,
+			Domain: s.opts.Domain,
+			Port:   t.port,
+			Addr:   t.addr,
+			Owner:  t.client.owner(),
+		}
+	}
+	t.client.mu.Lock()
+	metrics.ActiveConnections = len(t.channels)
+	t.client.mu.Unlock()
+
+	s.sshServer.mu.Lock()
+	domains := slices.Clone(t.domains)
+	s.sshServer.mu.Unlock()
+
+	return adminTunnel{
+		TunnelMetrics: metrics,
+		Bind:          t.bind,
+		ClientAddr:    t.client.tcpConn.RemoteAddr().String(),
+		Domains:       domains,
+		Auth:          t.auth != nil,
+		OIDC:          t.oidc != nil,
+		IPFilter:      t.ipFilter != nil,
+		UDP:           t.udp != nil,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
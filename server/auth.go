@@ -0,0 +1,258 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ssh.Permissions extensions used to pass the authenticated identity
+// from the auth callbacks to the connection handler.
+const (
+	permFingerprint = "fingerprint" // SHA256 fingerprint of the client key
+	permToken       = "token"       // name of the API token
+	permCert        = "cert"        // key ID of the user certificate
+	permIDs         = "ids"         // comma separated ID patterns the credential may claim
+)
+
+// authorizedKeys is a store of public keys backed by an OpenSSH
+// authorized_keys file. It holds both the keys allowed to connect and
+// the trusted user certificate authorities. The file is
+// re-read whenever its modification time changes, so keys can be added
+// or revoked without restarting the server.
+type authorizedKeys struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	keys    map[string]string // fingerprint -> comment
+}
+
+func newAuthorizedKeys(path string) *authorizedKeys {
+	return &authorizedKeys{
+		path: path,
+		keys: make(map[string]string),
+	}
+}
+
+// load reads the authorized_keys file if it was modified since the
+// last successful read.
+func (a *authorizedKeys) load() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(a.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]string)
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, comment, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", a.path, i+1, err)
+		}
+		keys[ssh.FingerprintSHA256(key)] = comment
+	}
+
+	a.keys = keys
+	a.modTime = info.ModTime()
+	return nil
+}
+
+// lookup returns the comment of the key with given fingerprint and
+// whether the key is authorized.
+func (a *authorizedKeys) lookup(fingerprint string) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	comment, ok := a.keys[fingerprint]
+	return comment, ok
+}
+
+func (s *SSHServer) publicKeyCallback(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		return s.certAuth(conn, cert)
+	}
+	if s.authorizedKeys == nil {
+		return nil, fmt.Errorf("public keys not accepted")
+	}
+
+	if err := s.authorizedKeys.load(); err != nil {
+		s.logger.Errorf("unable to load authorized keys: %v", err)
+	}
+
+	fingerprint := ssh.FingerprintSHA256(key)
+	comment, ok := s.authorizedKeys.lookup(fingerprint)
+	if !ok {
+		s.logger.Infof("rejected public key %s from %s", fingerprint, conn.RemoteAddr().String())
+		return nil, fmt.Errorf("unknown public key %s", fingerprint)
+	}
+
+	s.logger.Debugf("accepted public key %s (%s) from %s", fingerprint, comment, conn.RemoteAddr().String())
+	return &ssh.Permissions{
+		Extensions: map[string]string{permFingerprint: fingerprint},
+	}, nil
+}
+
+// certAuth accepts user certificates signed by one of the trusted CAs.
+// Certificate principals list the tunnel IDs the holder may claim, and
+// the SSH user, which clients set to the ID they claim, must match one.
+// Certificates without principals are rejected, like OpenSSH does.
+func (s *SSHServer) certAuth(conn ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, error) {
+	if s.userCAKeys == nil {
+		return nil, fmt.Errorf("certificates not accepted")
+	}
+	if err := s.userCAKeys.load(); err != nil {
+		s.logger.Errorf("unable to load trusted user CA keys: %v", err)
+	}
+
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("certificate has type %d", cert.CertType)
+	}
+	if _, ok := s.userCAKeys.lookup(ssh.FingerprintSHA256(cert.SignatureKey)); !ok {
+		s.logger.Infof("rejected certificate %q signed by unknown CA from %s", cert.KeyId, conn.RemoteAddr().String())
+		return nil, fmt.Errorf("certificate signed by unrecognized authority")
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		s.logger.Infof("rejected certificate %q without principals from %s", cert.KeyId, conn.RemoteAddr().String())
+		return nil, fmt.Errorf("certificate has no principals")
+	}
+
+	// Principals may be patterns, CheckCert then gets the one matching
+	// the user since it compares them literally.
+	principal := conn.User()
+	for _, p := range cert.ValidPrincipals {
+		if ok, _ := path.Match(p, conn.User()); ok {
+			principal = p
+			break
+		}
+	}
+	checker := &ssh.CertChecker{}
+	if err := checker.CheckCert(principal, cert); err != nil {
+		s.logger.Infof("rejected certificate %q from %s: %v", cert.KeyId, conn.RemoteAddr().String(), err)
+		return nil, err
+	}
+
+	s.logger.Debugf("accepted certificate %q (serial %d) from %s", cert.KeyId, cert.Serial, conn.RemoteAddr().String())
+	return &ssh.Permissions{
+		CriticalOptions: cert.CriticalOptions,
+		Extensions: map[string]string{
+			permFingerprint: ssh.FingerprintSHA256(cert.Key),
+			permCert:        cert.KeyId,
+			permIDs:         strings.Join(cert.ValidPrincipals, ","),
+		},
+	}, nil
+}
+
+func (s *SSHServer) passwordCallback(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	return s.tokenAuth(conn, string(password))
+}
+
+func (s *SSHServer) keyboardInteractiveCallback(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	answers, err := challenge("", "", []string{"Token: "}, []bool{false})
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) != 1 {
+		return nil, fmt.Errorf("expected one answer, got %d", len(answers))
+	}
+	return s.tokenAuth(conn, answers[0])
+}
+
+func (s *SSHServer) tokenAuth(conn ssh.ConnMetadata, secret string) (*ssh.Permissions, error) {
+	for _, t := range s.opts.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(secret)) != 1 {
+			continue
+		}
+		if !t.Expires.IsZero() && time.Now().After(t.Expires) {
+			s.logger.Infof("rejected expired token %q from %s", t.Name, conn.RemoteAddr().String())
+			return nil, fmt.Errorf("token %q expired", t.Name)
+		}
+
+		s.logger.Debugf("accepted token %q from %s", t.Name, conn.RemoteAddr().String())
+		perms := &ssh.Permissions{
+			Extensions: map[string]string{permToken: t.Name},
+		}
+		if len(t.IDs) > 0 {
+			perms.Extensions[permIDs] = strings.Join(t.IDs, ",")
+		}
+		return perms, nil
+	}
+
+	s.logger.Infof("rejected unknown token from %s", conn.RemoteAddr().String())
+	return nil, fmt.Errorf("invalid token")
+}
+
+// reserved reports whether the tunnel ID is reserved by any key.
+func (s *SSHServer) reserved(id string) bool {
+	for _, r := range s.opts.Reservations {
+		if matchID(r.IDs, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// canClaim returns an error if the client is not allowed to use the
+// tunnel ID. Credentials restricted to a set of IDs may claim only those,
+// and may claim them even if reserved. Otherwise reserved IDs may only
+// be claimed by the key they are reserved for.
+func (s *SSHServer) canClaim(c *client, id string) error {
+	if c.allowedIDs != nil {
+		if matchID(c.allowedIDs, id) {
+			return nil
+		}
+		return fmt.Errorf("id %q is not allowed for this credential", id)
+	}
+	if !s.reserved(id) {
+		return nil
+	}
+	for _, r := range s.opts.Reservations {
+		if c.fingerprint != "" && r.Fingerprint == c.fingerprint && matchID(r.IDs, id) {
+			return nil
+		}
+	}
+	return fmt.Errorf("id %q is reserved", id)
+}
+
+// checkClaimed returns an error if the client is restricted to a set of
+// tunnel IDs but hasn't claimed one for the next tunnel, which would
+// otherwise get a random ID outside the set.
+func (s *SSHServer) checkClaimed(c *client) error {
+	if c.allowedIDs == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.nextID == "" {
+		return fmt.Errorf("this credential may only open tunnels with an allowed id")
+	}
+	return nil
+}
+
+func matchID(patterns []string, id string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, id); ok {
+			return true
+		}
+	}
+	return false
+}
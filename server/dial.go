@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newTunnelTransport returns HTTP transport whose connections are
+// forwarded-tcpip channels opened directly on the client SSH connection,
+// so proxying HTTP doesn't go through the tunnel's TCP listener. The
+// connections are reused across visitors, so their channels originate
+// from the server, the client learns visitors from X-Forwarded-For.
+func (s *SSHServer) newTunnelTransport(t *tunnel) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return s.dialTunnel(t, t.client.sshConn.LocalAddr().String())
+		},
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// dialTunnel opens forwarded-tcpip channel to the client as if origin
+// connected to the tunnel listener.
+func (s *SSHServer) dialTunnel(t *tunnel, origin string) (net.Conn, error) {
+	raddr := &net.TCPAddr{IP: net.IPv4zero}
+	if host, port, err := net.SplitHostPort(origin); err == nil {
+		raddr.IP = net.ParseIP(host)
+		raddr.Port, _ = strconv.Atoi(port)
+	}
+
+	payload := forwardedTCPPayload{t.addr, t.port, raddr.IP.String(), uint32(raddr.Port)}
+	c, requests, err := t.client.sshConn.OpenChannel("forwarded-tcpip", ssh.Marshal(&payload))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open channel: %w", err)
+	}
+	s.logger.Debugf("[%s] channel opened for client %s:%d <-> %s", t.id, t.addr, t.port, raddr)
+
+	go ssh.DiscardRequests(requests)
+
+	t.client.mu.Lock()
+	t.channels[c] = true
+	t.client.mu.Unlock()
+
+	return &channelConn{
+		Channel: c,
+		tunnel:  t,
+		laddr:   &net.TCPAddr{IP: net.ParseIP(t.addr), Port: int(t.port)},
+		raddr:   raddr,
+	}, nil
+}
+
+// channelConn is a forwarded-tcpip channel used as net.Conn. Deadlines
+// are not supported.
+type channelConn struct {
+	ssh.Channel
+	tunnel *tunnel
+	laddr  net.Addr
+	raddr  net.Addr
+	once   sync.Once
+}
+
+func (c *channelConn) Close() error {
+	c.once.Do(func() {
+		c.tunnel.client.mu.Lock()
+		delete(c.tunnel.channels, c.Channel)
+		c.tunnel.client.mu.Unlock()
+	})
+	return c.Channel.Close()
+}
+
+func (c *channelConn) LocalAddr() net.Addr                { return c.laddr }
+func (c *channelConn) RemoteAddr() net.Addr               { return c.raddr }
+func (c *channelConn) SetDeadline(t time.Time) error      { return nil }
+func (c *channelConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *channelConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// domainChallengePrefix is prepended to the custom domain to get the
+// name of the TXT record proving its ownership.
+const domainChallengePrefix = "_bore-challenge."
+
+// domainToken returns the TXT record value owner has to publish to
+// attach host to their tunnels. It is derived from the owner identity,
+// so it stays the same across connections and can't be reused by other
+// owners.
+func domainToken(owner, host string) string {
+	sum := sha256.Sum256([]byte(owner + "\x00" + host))
+	return "bore-verify=" + hex.EncodeToString(sum[:16])
+}
+
+// normalizeHost lowercases host and strips the trailing dot.
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// newResolver returns resolver querying given DNS server, or the system
+// resolver if addr is empty.
+func newResolver(addr string) *net.Resolver {
+	if addr == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// addDomain verifies the tunnel owner controls host and routes requests
+// for host to the tunnel until it is closed.
+func (s *SSHServer) addDomain(t *tunnel, host string) error {
+	if !s.opts.CustomDomains {
+		return fmt.Errorf("custom domains are disabled on this server")
+	}
+
+	host = normalizeHost(host)
+	if host == "" || strings.ContainsAny(host, "/:@ ") {
+		return fmt.Errorf("invalid domain %q", host)
+	}
+	if host == s.domain || strings.HasSuffix(host, "."+s.domain) {
+		return fmt.Errorf("subdomains of %s are assigned by tunnel id", s.domain)
+	}
+
+	owner := t.client.owner()
+	if owner == "" {
+		return fmt.Errorf("custom domains require authentication")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.verifyDomain(ctx, owner, host); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id, ok := s.domains[host]; ok && id != t.id {
+		if _, open := s.tunnels[id]; open {
+			return fmt.Errorf("domain %s is attached to another tunnel", host)
+		}
+	}
+	s.domains[host] = t.id
+	t.domains = append(t.domains, host)
+	return nil
+}
+
+// verifyDomain checks the TXT record proving owner controls host.
+func (s *SSHServer) verifyDomain(ctx context.Context, owner, host string) error {
+	name := domainChallengePrefix + host
+	want := domainToken(owner, host)
+
+	records, err := s.resolver.LookupTXT(ctx, name)
+	if err != nil {
+		s.logger.Debugf("TXT lookup of %s failed: %v", name, err)
+	}
+	for _, record := range records {
+		if record == want {
+			return nil
+		}
+	}
+	return fmt.Errorf("add TXT record %s with value %q to verify ownership of %s", name, want, host)
+}
+
+// removeDomains removes the custom domains routed to the tunnel. It must
+// be called with s.mu held.
+func (s *SSHServer) removeDomains(t *tunnel) {
+	for _, host := range t.domains {
+		if s.domains[host] == t.id {
+			delete(s.domains, host)
+		}
+	}
+	t.domains = nil
+}
+
+// domainTunnel returns ID of the tunnel custom domain host is attached to.
+func (s *SSHServer) domainTunnel(host string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.domains[normalizeHost(host)]
+	return id, ok
+}
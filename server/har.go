@@ -0,0 +1,244 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/jkuri/bore/pkg/har"
+)
+
+const (
+	defaultHARDuration = 30 * time.Second
+	maxHARDuration     = 10 * time.Minute
+	defaultHARLimit    = 100
+	maxHARLimit        = 1000
+
+	// maxHARBody limits how much of each body is kept in captures.
+	maxHARBody = 1 << 20
+)
+
+// harCapture collects HTTP requests to a tunnel requested over the
+// admin API.
+type harCapture struct {
+	mu      sync.Mutex
+	limit   int
+	redact  []string
+	entries []har.Entry
+	full    chan struct{} // closed once limit entries are collected
+}
+
+func newHARCapture(limit int, redact []string) *harCapture {
+	return &harCapture{limit: limit, redact: redact, full: make(chan struct{})}
+}
+
+func (c *harCapture) add(ex har.Exchange) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.limit {
+		return
+	}
+	c.entries = append(c.entries, har.NewEntry(ex, c.redact))
+	if len(c.entries) == c.limit {
+		close(c.full)
+	}
+}
+
+func (c *harCapture) log() *har.HAR {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	log := har.New()
+	log.Log.Entries = append(log.Log.Entries, c.entries...)
+	return log
+}
+
+// harCaptures holds captures in progress by tunnel ID.
+type harCaptures struct {
+	mu      sync.Mutex
+	tunnels map[string][]*harCapture
+}
+
+func newHARCaptures() *harCaptures {
+	return &harCaptures{tunnels: make(map[string][]*harCapture)}
+}
+
+func (c *harCaptures) add(id string, capture *harCapture) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tunnels[id] = append(c.tunnels[id], capture)
+}
+
+func (c *harCaptures) remove(id string, capture *harCapture) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	list := c.tunnels[id]
+	for i, hc := range list {
+		if hc == capture {
+			list = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(c.tunnels, id)
+	} else {
+		c.tunnels[id] = list
+	}
+}
+
+func (c *harCaptures) active(id string) []*harCapture {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tunnels[id]
+}
+
+// serveCaptured serves the request with h and adds the exchange to
+// captures.
+func serveCaptured(captures []*harCapture, h http.Handler, w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	ex := har.Exchange{
+		Started:       time.Now(),
+		Method:        r.Method,
+		URL:           scheme + "://" + r.Host + r.RequestURI,
+		Proto:         r.Proto,
+		RequestHeader: r.Header.Clone(),
+	}
+
+	reqBody := &harBody{}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, reqBody), r.Body}
+	}
+
+	var status int
+	respBody := &harBody{}
+	wrapped := httpsnoop.Wrap(w, httpsnoop.Hooks{
+		WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+			return func(code int) {
+				if status == 0 && code >= 200 {
+					status = code
+				}
+				next(code)
+			}
+		},
+		Write: func(next httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+			return func(b []byte) (int, error) {
+				if status == 0 {
+					status = http.StatusOK
+				}
+				n, err := next(b)
+				respBody.Write(b[:n])
+				return n, err
+			}
+		},
+		ReadFrom: func(next httpsnoop.ReadFromFunc) httpsnoop.ReadFromFunc {
+			return func(src io.Reader) (int64, error) {
+				if status == 0 {
+					status = http.StatusOK
+				}
+				return next(io.TeeReader(src, respBody))
+			}
+		},
+	})
+
+	h.ServeHTTP(wrapped, r)
+
+	if status == 0 {
+		status = http.StatusOK
+	}
+	ex.Duration = time.Since(ex.Started)
+	ex.RequestBody, ex.RequestBodySize = reqBody.result()
+	ex.Status = status
+	ex.ResponseProto = r.Proto
+	ex.ResponseHeader = w.Header().Clone()
+	ex.ResponseBody, ex.ResponseBodySize = respBody.result()
+	for _, c := range captures {
+		c.add(ex)
+	}
+}
+
+// harBody keeps the first maxHARBody bytes written to it.
+type harBody struct {
+	mu   sync.Mutex
+	buf  []byte
+	size int64
+}
+
+func (b *harBody) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.size += int64(len(p))
+	if room := maxHARBody - len(b.buf); room > 0 {
+		b.buf = append(b.buf, p[:min(len(p), room)]...)
+	}
+	return len(p), nil
+}
+
+func (b *harBody) result() ([]byte, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf, b.size
+}
+
+// adminCaptureHAR records HTTP requests to the tunnel until duration
+// elapses or limit requests are recorded and replies with them as HAR
+// log. Headers listed in redact, by default Authorization and cookies,
+// have their values redacted.
+func (s *BoreServer) adminCaptureHAR(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.lookupTunnel(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+
+	q := r.URL.Query()
+	duration := defaultHARDuration
+	if v := q.Get("duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > maxHARDuration {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("duration must be between 0 and %s", maxHARDuration))
+			return
+		}
+		duration = d
+	}
+	limit := defaultHARLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxHARLimit {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxHARLimit))
+			return
+		}
+		limit = n
+	}
+	redact := har.DefaultRedact
+	if q.Has("redact") {
+		redact = har.ParseRedact(q.Get("redact"))
+	}
+
+	capture := newHARCapture(limit, redact)
+	s.captures.add(t.id, capture)
+	s.httpServer.logger.Infof("[%s] capturing HTTP requests for %s on admin request", t.id, duration)
+
+	timer := time.NewTimer(duration)
+	select {
+	case <-timer.C:
+	case <-capture.full:
+	case <-r.Context().Done():
+	}
+	timer.Stop()
+	s.captures.remove(t.id, capture)
+	if r.Context().Err() != nil {
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", t.id+".har"))
+	writeJSON(w, http.StatusOK, capture.log())
+}
@@ -0,0 +1,437 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	minuteSlots = 24 * 60 // a day at minute resolution
+	hourSlots   = 90 * 24 // 90 days at hour resolution
+
+	// maxHistoryPoints limits the number of points a query returns.
+	maxHistoryPoints = 2000
+
+	// maxHistoryTime is the latest time accepted in queries, the end of
+	// year 9999 in Unix seconds.
+	maxHistoryTime = 253402300799
+
+	// maxHistoryTunnels limits the number of tunnel IDs history is kept
+	// for, the one idle the longest is dropped to make room for a new one.
+	maxHistoryTunnels = 4096
+)
+
+// historyPoint is traffic recorded within one bucket of a ring. Time
+// is the bucket start in Unix seconds.
+type historyPoint struct {
+	Time     int64  `json:"time"`
+	BytesIn  uint64 `json:"bytesIn"`
+	BytesOut uint64 `json:"bytesOut"`
+}
+
+// ring keeps points of a fixed step for the last Slots buckets. Only
+// buckets with traffic are stored, so tunnels that are rarely used take
+// little memory. Buckets older than Slots steps are dropped by prune.
+type ring struct {
+	Step   int64 // seconds
+	Slots  int
+	Points map[int64]*historyPoint // keyed by bucket start
+}
+
+func newRing(step time.Duration, slots int) *ring {
+	return &ring{Step: int64(step / time.Second), Slots: slots, Points: make(map[int64]*historyPoint)}
+}
+
+// ringJSON is the persisted form of a ring.
+type ringJSON struct {
+	Step   int64          `json:"step"`
+	Slots  int            `json:"slots"`
+	Points []historyPoint `json:"points"`
+}
+
+func (r *ring) MarshalJSON() ([]byte, error) {
+	v := ringJSON{Step: r.Step, Slots: r.Slots, Points: make([]historyPoint, 0, len(r.Points))}
+	for _, p := range r.Points {
+		v.Points = append(v.Points, *p)
+	}
+	sort.Slice(v.Points, func(i, j int) bool { return v.Points[i].Time < v.Points[j].Time })
+	return json.Marshal(v)
+}
+
+func (r *ring) UnmarshalJSON(data []byte) error {
+	var v ringJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if v.Step <= 0 || v.Slots <= 0 {
+		return fmt.Errorf("invalid ring step %d or slots %d", v.Step, v.Slots)
+	}
+	r.Step = v.Step
+	r.Slots = v.Slots
+	r.Points = make(map[int64]*historyPoint, len(v.Points))
+	for _, p := range v.Points {
+		if p.Time > 0 && p.Time%r.Step == 0 {
+			r.Points[p.Time] = &p
+		}
+	}
+	return nil
+}
+
+func (r *ring) add(t time.Time, in, out uint64) {
+	bucket := t.Unix() - t.Unix()%r.Step
+	p, ok := r.Points[bucket]
+	if !ok {
+		p = &historyPoint{Time: bucket}
+		r.Points[bucket] = p
+	}
+	p.BytesIn += in
+	p.BytesOut += out
+}
+
+// get returns the point of bucket starting at given Unix time.
+func (r *ring) get(bucket int64) (historyPoint, bool) {
+	if p, ok := r.Points[bucket]; ok {
+		return *p, true
+	}
+	return historyPoint{}, false
+}
+
+// retention returns the oldest bucket start still kept at now.
+func (r *ring) retention(now time.Time) int64 {
+	latest := now.Unix() - now.Unix()%r.Step
+	return latest - r.Step*int64(r.Slots-1)
+}
+
+// prune drops buckets older than the retention at now.
+func (r *ring) prune(now time.Time) {
+	oldest := r.retention(now)
+	for bucket := range r.Points {
+		if bucket < oldest {
+			delete(r.Points, bucket)
+		}
+	}
+}
+
+// series is traffic history of a tunnel, or the whole server. BytesIn
+// and BytesOut count all traffic since the series was created.
+type series struct {
+	Minutes  *ring  `json:"minutes"`
+	Hours    *ring  `json:"hours"`
+	Last     int64  `json:"last"` // Unix time of last recorded traffic
+	BytesIn  uint64 `json:"bytesIn"`
+	BytesOut uint64 `json:"bytesOut"`
+}
+
+func newSeries() *series {
+	return &series{
+		Minutes: newRing(time.Minute, minuteSlots),
+		Hours:   newRing(time.Hour, hourSlots),
+	}
+}
+
+// history records traffic per tunnel ID and server-wide at minute and
+// hour resolution and persists it to file, if set. Tunnels without
+// traffic within the retention of the hour ring are forgotten.
+type history struct {
+	mu     sync.Mutex
+	file   string
+	server *series
+	// tunnels are keyed by tunnel ID, so history survives reconnects.
+	tunnels map[string]*series
+	logger  *zap.SugaredLogger
+}
+
+func newHistory(file string, logger *zap.SugaredLogger) *history {
+	h := &history{
+		file:    file,
+		server:  newSeries(),
+		tunnels: make(map[string]*series),
+		logger:  logger,
+	}
+	if file != "" {
+		if err := h.load(); err != nil && !os.IsNotExist(err) {
+			logger.Errorf("failed to load metrics history from %s: %v", file, err)
+		}
+	}
+	return h
+}
+
+// record adds traffic of the tunnel to its and the server-wide series.
+func (h *history) record(id string, in, out uint64, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, s := range []*series{h.server, h.tunnel(id)} {
+		s.Minutes.add(now, in, out)
+		s.Hours.add(now, in, out)
+		s.Last = now.Unix()
+		s.BytesIn += in
+		s.BytesOut += out
+	}
+}
+
+// tunnelTotal is traffic of a tunnel ID over all its connections.
+type tunnelTotal struct {
+	ID       string
+	BytesIn  uint64
+	BytesOut uint64
+}
+
+// totals returns traffic of every tunnel ID history is kept for, sorted
+// by ID.
+func (h *history) totals() []tunnelTotal {
+	h.mu.Lock()
+	list := make([]tunnelTotal, 0, len(h.tunnels))
+	for id, s := range h.tunnels {
+		list = append(list, tunnelTotal{id, s.BytesIn, s.BytesOut})
+	}
+	h.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (h *history) tunnel(id string) *series {
+	s, ok := h.tunnels[id]
+	if !ok {
+		if len(h.tunnels) >= maxHistoryTunnels {
+			h.evict()
+		}
+		s = newSeries()
+		h.tunnels[id] = s
+	}
+	return s
+}
+
+// evict drops the tunnel idle the longest.
+func (h *history) evict() {
+	var oldest string
+	for id, s := range h.tunnels {
+		if oldest == "" || s.Last < h.tunnels[oldest].Last {
+			oldest = id
+		}
+	}
+	delete(h.tunnels, oldest)
+}
+
+// prune drops buckets past retention and tunnels left without any.
+func (h *history) prune(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.server.Minutes.prune(now)
+	h.server.Hours.prune(now)
+	oldest := h.server.Hours.retention(now)
+	for id, s := range h.tunnels {
+		if s.Last < oldest {
+			delete(h.tunnels, id)
+			continue
+		}
+		s.Minutes.prune(now)
+		s.Hours.prune(now)
+	}
+}
+
+// query returns points between from and to summed into buckets of
+// step. The hour ring is used when step is a multiple of an hour or
+// from is older than the minute ring keeps. The range is clamped to
+// what the ring keeps and to now. Buckets with no traffic are returned
+// as zero.
+func (h *history) query(id string, from, to time.Time, step time.Duration) ([]historyPoint, time.Duration, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.server
+	if id != "" {
+		var ok bool
+		if s, ok = h.tunnels[id]; !ok {
+			s = newSeries()
+		}
+	}
+
+	now := time.Now()
+	r := s.Minutes
+	if step%time.Hour == 0 || from.Unix() < r.retention(now) {
+		r = s.Hours
+	}
+	res := time.Duration(r.Step) * time.Second
+	if step < res {
+		step = res
+	}
+	step = step.Truncate(res)
+
+	// Clamp before any arithmetic, so times far off can't overflow.
+	oldest := r.retention(now)
+	first := max(from.Unix(), oldest)
+	last := min(to.Unix(), now.Unix())
+	points := []historyPoint{}
+	if first > last {
+		return points, step, nil
+	}
+
+	stepSec := int64(step / time.Second)
+	start := first - first%stepSec
+	if n := (last-start)/stepSec + 1; n > maxHistoryPoints {
+		return nil, 0, fmt.Errorf("too many points (%d), increase step", n)
+	}
+
+	for t := start; t <= last; t += stepSec {
+		p := historyPoint{Time: t}
+		for b := max(t, oldest); b < t+stepSec && b <= last; b += r.Step {
+			if v, ok := r.get(b); ok {
+				p.BytesIn += v.BytesIn
+				p.BytesOut += v.BytesOut
+			}
+		}
+		points = append(points, p)
+	}
+	return points, step, nil
+}
+
+// run prunes history every minute and saves it, if file is set.
+func (h *history) run() {
+	for now := range time.Tick(time.Minute) {
+		h.prune(now)
+		h.persist()
+	}
+}
+
+// persist saves history to file, if set, and logs failures.
+func (h *history) persist() {
+	if h.file == "" {
+		return
+	}
+	if err := h.save(); err != nil {
+		h.logger.Errorf("failed to save metrics history to %s: %v", h.file, err)
+	}
+}
+
+type historyFile struct {
+	Server  *series            `json:"server"`
+	Tunnels map[string]*series `json:"tunnels"`
+}
+
+// save writes history to file.
+func (h *history) save() error {
+	h.mu.Lock()
+	data, err := json.Marshal(historyFile{Server: h.server, Tunnels: h.tunnels})
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(h.file), ".history-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), h.file)
+}
+
+func (h *history) load() error {
+	data, err := os.ReadFile(h.file)
+	if err != nil {
+		return err
+	}
+	var f historyFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if validSeries(f.Server) {
+		h.server = f.Server
+	}
+	for id, s := range f.Tunnels {
+		if validSeries(s) {
+			if len(h.tunnels) >= maxHistoryTunnels {
+				h.evict()
+			}
+			h.tunnels[id] = s
+		}
+	}
+	return nil
+}
+
+// validSeries reports whether s was saved with the current ring layout.
+func validSeries(s *series) bool {
+	return s != nil && s.Minutes != nil && s.Hours != nil &&
+		s.Minutes.Step == 60 && s.Minutes.Slots == minuteSlots &&
+		s.Hours.Step == 3600 && s.Hours.Slots == hourSlots
+}
+
+// HandleHistory serves traffic history of a tunnel, or the whole server
+// if no tunnel is given. from and to are Unix seconds or RFC 3339 and
+// default to the last hour, step is a duration such as 5m.
+func (h *MetricsHub) HandleHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	now := time.Now()
+
+	to, err := parseHistoryTime(q.Get("to"), now)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid to: "+err.Error())
+		return
+	}
+	from, err := parseHistoryTime(q.Get("from"), to.Add(-time.Hour))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid from: "+err.Error())
+		return
+	}
+	if from.After(to) {
+		writeJSONError(w, http.StatusBadRequest, "from must not be after to")
+		return
+	}
+	step := time.Minute
+	if v := q.Get("step"); v != "" {
+		if step, err = time.ParseDuration(v); err != nil || step <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid step")
+			return
+		}
+	}
+
+	tunnel := q.Get("tunnel")
+	points, step, err := h.history.query(tunnel, from, to, step)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Tunnel string         `json:"tunnel,omitempty"`
+		Step   int64          `json:"step"`
+		Points []historyPoint `json:"points"`
+	}{tunnel, int64(step / time.Second), points})
+}
+
+func parseHistoryTime(v string, def time.Time) (time.Time, error) {
+	if v == "" {
+		return def, nil
+	}
+	var t time.Time
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		t = time.Unix(sec, 0)
+	} else if t, err = time.Parse(time.RFC3339, v); err != nil {
+		return t, err
+	}
+	if sec := t.Unix(); sec < 0 || sec > maxHistoryTime {
+		return t, fmt.Errorf("time out of range")
+	}
+	return t, nil
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestHistoryQueryRange(t *testing.T) {
+	hub := &MetricsHub{history: newHistory("", zap.NewNop().Sugar())}
+	hub.history.record("app", 100, 200, time.Now())
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{"last hour", "tunnel=app", http.StatusOK},
+		{"min int64 from", "from=-9223372036854775808", http.StatusBadRequest},
+		{"negative from", "from=-1", http.StatusBadRequest},
+		{"from 1970", "from=0&step=2h", http.StatusOK},
+		{"max int64 to", "to=9223372036854775807", http.StatusBadRequest},
+		{"far future to", "from=0&to=253402300799&step=2h", http.StatusOK},
+		{"too many points", "from=0&step=1h", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done := make(chan *httptest.ResponseRecorder)
+			go func() {
+				w := httptest.NewRecorder()
+				hub.HandleHistory(w, httptest.NewRequest(http.MethodGet, "/api/metrics/history?"+tt.query, nil))
+				done <- w
+			}()
+
+			var w *httptest.ResponseRecorder
+			select {
+			case w = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("query did not return")
+			}
+			if w.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var res struct {
+				Points []historyPoint `json:"points"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Points) == 0 || len(res.Points) > maxHistoryPoints {
+				t.Fatalf("got %d points", len(res.Points))
+			}
+			if last := res.Points[len(res.Points)-1]; last.Time > time.Now().Unix() {
+				t.Fatalf("got point in the future at %d", last.Time)
+			}
+		})
+	}
+}
+
+func TestHistoryQueryTraffic(t *testing.T) {
+	h := newHistory("", zap.NewNop().Sugar())
+	now := time.Now()
+	h.record("app", 100, 200, now)
+	h.record("app", 1, 2, now.Add(-2*time.Hour))
+
+	points, _, err := h.query("app", now.Add(-3*time.Hour), now, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var in, out uint64
+	for _, p := range points {
+		in += p.BytesIn
+		out += p.BytesOut
+	}
+	if in != 101 || out != 202 {
+		t.Fatalf("got %d bytes in and %d out, want 101 and 202", in, out)
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
@@ -43,6 +44,23 @@ func (h *HTTPServer) Run(addr string, handler http.Handler) error {
 	return nil
 }
 
+// RunTLS starts HTTPServer instance serving TLS with given config and
+// listens on specified addr.
+func (h *HTTPServer) RunTLS(addr string, handler http.Handler, config *tls.Config) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	h.Handler = handler
+	h.TLSConfig = config
+	h.listener = listener
+
+	h.logger.Infof("starting HTTPS server on %s", addr)
+
+	go h.closeWith(h.ServeTLS(listener, "", ""))
+	return nil
+}
+
 // Close closes the HTTPServer instance
 func (h *HTTPServer) Close() error {
 	h.closeWith(nil)
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// tunnelAuth is the protection the client requested for the tunnel's
+// HTTP endpoint. Requests must carry either the basic auth credentials
+// or the bearer token, whichever are set.
+type tunnelAuth struct {
+	username string
+	password string
+	bearer   string
+}
+
+func newTunnelAuth(payload setAuthPayload) (*tunnelAuth, error) {
+	if payload.Username == "" && payload.Password == "" && payload.Bearer == "" {
+		return nil, nil
+	}
+	if payload.Username == "" && payload.Password != "" {
+		return nil, fmt.Errorf("basic auth requires username")
+	}
+	if strings.Contains(payload.Username, ":") {
+		return nil, fmt.Errorf("basic auth username must not contain colon")
+	}
+	return &tunnelAuth{
+		username: payload.Username,
+		password: payload.Password,
+		bearer:   payload.Bearer,
+	}, nil
+}
+
+// check reports whether the request carries valid credentials.
+func (a *tunnelAuth) check(r *http.Request) bool {
+	if a.username != "" {
+		if user, pass, ok := r.BasicAuth(); ok {
+			userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.username)) == 1
+			passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(a.password)) == 1
+			if userOK && passOK {
+				return true
+			}
+		}
+	}
+	if a.bearer != "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(a.bearer)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// challenge replies with 401 asking for the accepted credentials.
+func (a *tunnelAuth) challenge(w http.ResponseWriter) {
+	if a.username != "" {
+		w.Header().Add("WWW-Authenticate", `Basic realm="bore", charset="UTF-8"`)
+	}
+	if a.bearer != "" {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="bore"`)
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coder/websocket"
@@ -16,6 +17,7 @@ type TunnelMetrics struct {
 	Domain             string    `json:"domain"`
 	Port               uint32    `json:"port"`
 	Addr               string    `json:"addr"`
+	Owner              string    `json:"owner,omitempty"`
 	BytesIn            uint64    `json:"bytesIn"`
 	BytesOut           uint64    `json:"bytesOut"`
 	CumulativeBytesIn  uint64    `json:"cumulativeBytesIn"`
@@ -51,6 +53,12 @@ type MetricsHub struct {
 	broadcastTicker *time.Ticker
 	serverStats     ServerStats
 	lastStatsUpdate time.Time
+
+	httpResponses     map[int]uint64 // by status code
+	proxyLatency      *histogram
+	handshakeFailures atomic.Uint64
+
+	history *history
 }
 
 func NewMetricsHub(sshServer *SSHServer, logger *zap.SugaredLogger) *MetricsHub {
@@ -60,7 +68,11 @@ func NewMetricsHub(sshServer *SSHServer, logger *zap.SugaredLogger) *MetricsHub
 		sshServer:       sshServer,
 		logger:          logger,
 		lastStatsUpdate: time.Now(),
+		httpResponses:   make(map[int]uint64),
+		proxyLatency:    newHistogram(),
+		history:         newHistory(sshServer.opts.HistoryFile, logger),
 	}
+	go hub.history.run()
 
 	hub.broadcastTicker = time.NewTicker(200 * time.Millisecond)
 	go hub.broadcastLoop()
@@ -174,26 +186,27 @@ func (h *MetricsHub) collectMetrics() []TunnelMetrics {
 	h.sshServer.mu.Lock()
 	defer h.sshServer.mu.Unlock()
 
-	metrics := make([]TunnelMetrics, 0, len(h.sshServer.clients))
+	metrics := make([]TunnelMetrics, 0, len(h.sshServer.tunnels))
 	now := time.Now()
 
-	for id, client := range h.sshServer.clients {
+	for id, tunnel := range h.sshServer.tunnels {
 		h.mu.Lock()
 		metric, exists := h.tunnelMetrics[id]
 		if !exists {
 			metric = &TunnelMetrics{
 				ID:           id,
 				Domain:       h.sshServer.domain,
-				Port:         client.port,
-				Addr:         client.addr,
+				Port:         tunnel.port,
+				Addr:         tunnel.addr,
+				Owner:        tunnel.client.owner(),
 				ConnectedAt:  now,
 				LastActivity: now,
 			}
 			h.tunnelMetrics[id] = metric
 		}
 
-		metric.Port = client.port
-		metric.Addr = client.addr
+		metric.Port = tunnel.port
+		metric.Addr = tunnel.addr
 
 		elapsed := now.Sub(metric.LastActivity).Seconds()
 		if elapsed >= 1.0 {
@@ -204,9 +217,9 @@ func (h *MetricsHub) collectMetrics() []TunnelMetrics {
 			metric.LastActivity = now
 		}
 
-		client.mu.Lock()
-		metric.ActiveConnections = len(client.channels)
-		client.mu.Unlock()
+		tunnel.client.mu.Lock()
+		metric.ActiveConnections = len(tunnel.channels)
+		tunnel.client.mu.Unlock()
 
 		metrics = append(metrics, *metric)
 		h.mu.Unlock()
@@ -214,7 +227,7 @@ func (h *MetricsHub) collectMetrics() []TunnelMetrics {
 
 	h.mu.Lock()
 	for id := range h.tunnelMetrics {
-		if _, exists := h.sshServer.clients[id]; !exists {
+		if _, exists := h.sshServer.tunnels[id]; !exists {
 			delete(h.tunnelMetrics, id)
 		}
 	}
@@ -223,6 +236,16 @@ func (h *MetricsHub) collectMetrics() []TunnelMetrics {
 	return metrics
 }
 
+// tunnelMetric returns a copy of the tunnel's last collected metrics.
+func (h *MetricsHub) tunnelMetric(id string) (TunnelMetrics, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if metric, exists := h.tunnelMetrics[id]; exists {
+		return *metric, true
+	}
+	return TunnelMetrics{}, false
+}
+
 func (h *MetricsHub) RecordTraffic(tunnelID string, bytesIn, bytesOut uint64) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
@@ -235,6 +258,8 @@ func (h *MetricsHub) RecordTraffic(tunnelID string, bytesIn, bytesOut uint64) {
 		metric.LastActivity = time.Now()
 	}
 
+	h.history.record(tunnelID, bytesIn, bytesOut, time.Now())
+
 	h.serverStats.TotalBytesIn += bytesIn
 	h.serverStats.TotalBytesOut += bytesOut
 	h.serverStats.CumulativeBytesIn += bytesIn
@@ -257,8 +282,10 @@ func (h *MetricsHub) updateServerStats() {
 	}
 }
 
+// Close stops broadcasting and saves traffic history.
 func (h *MetricsHub) Close() {
 	if h.broadcastTicker != nil {
 		h.broadcastTicker.Stop()
 	}
+	h.history.persist()
 }
@@ -0,0 +1,502 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	oidcCallbackPath = "/oidc/callback"
+	oidcSessionPath  = "/.bore/oidc/session"
+	oidcCookie       = "bore_session"
+	oidcLoginTimeout = 10 * time.Minute
+	oidcTicketTTL    = time.Minute
+
+	// maxOIDCPending limits logins in progress, the oldest is dropped
+	// to make room for a new one.
+	maxOIDCPending = 10000
+)
+
+// tunnelOIDC is the login requirement the client set for the tunnel.
+// Users must log in with the server's OIDC provider and, if either list
+// is set, have email in one of the domains or belong to one of the
+// groups.
+type tunnelOIDC struct {
+	domains []string
+	groups  []string
+}
+
+func newTunnelOIDC(payload setOIDCPayload) *tunnelOIDC {
+	split := func(s string) []string {
+		var list []string
+		for _, v := range strings.Split(s, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				list = append(list, v)
+			}
+		}
+		return list
+	}
+	return &tunnelOIDC{
+		domains: split(strings.ToLower(payload.Domains)),
+		groups:  split(payload.Groups),
+	}
+}
+
+// allows reports whether the logged in user may access the tunnel.
+func (a *tunnelOIDC) allows(sess *oidcSession) bool {
+	if len(a.domains) == 0 && len(a.groups) == 0 {
+		return true
+	}
+	if _, domain, ok := strings.Cut(sess.Email, "@"); ok && sess.EmailVerified && slices.Contains(a.domains, strings.ToLower(domain)) {
+		return true
+	}
+	for _, group := range sess.Groups {
+		if slices.Contains(a.groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcSession is the signed content of the session cookie and of the
+// ticket the callback hands over to the tunnel host.
+type oidcSession struct {
+	Host          string   `json:"h"`
+	Email         string   `json:"e"`
+	EmailVerified bool     `json:"v"`
+	Groups        []string `json:"g,omitempty"`
+	Expires       int64    `json:"x"`
+}
+
+// oidcLogin is a login in progress, keyed by the state parameter.
+type oidcLogin struct {
+	host     string
+	path     string
+	verifier string
+	nonce    string
+	expires  time.Time
+}
+
+type oidcConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+// oidcProvider implements OpenID Connect authorization code flow with
+// PKCE. The login callback is served on the main domain, which then
+// hands a short-lived ticket to the tunnel host, so the session cookie
+// is scoped to the tunnel host only.
+type oidcProvider struct {
+	mu      sync.Mutex
+	opts    OIDC
+	domain  string
+	key     []byte
+	config  *oidcConfig
+	pending map[string]*oidcLogin
+	client  *http.Client
+	logger  *zap.SugaredLogger
+}
+
+func newOIDCProvider(opts OIDC, domain string, logger *zap.SugaredLogger) (*oidcProvider, error) {
+	key := []byte(opts.SessionKey)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := crand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return &oidcProvider{
+		opts:    opts,
+		domain:  domain,
+		key:     key,
+		pending: make(map[string]*oidcLogin),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		logger:  logger,
+	}, nil
+}
+
+// authorize checks the session of the request to the tunnel. Requests
+// without a valid session are redirected to login, logged in users not
+// allowed to access the tunnel get 403. It returns the session and true
+// if the request may proceed.
+func (p *oidcProvider) authorize(w http.ResponseWriter, r *http.Request, host string, access *tunnelOIDC) (*oidcSession, bool) {
+	if cookie, err := r.Cookie(oidcCookie); err == nil {
+		var sess oidcSession
+		if p.verify(cookie.Value, &sess) == nil && sess.Host == host && time.Now().Unix() < sess.Expires {
+			if !access.allows(&sess) {
+				http.Error(w, fmt.Sprintf("%s is not allowed to access this tunnel", sess.Email), http.StatusForbidden)
+				return nil, false
+			}
+			return &sess, true
+		}
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return nil, false
+	}
+	p.login(w, r, host)
+	return nil, false
+}
+
+// login redirects to the provider's authorization endpoint.
+func (p *oidcProvider) login(w http.ResponseWriter, r *http.Request, host string) {
+	config, err := p.discover(r.Context())
+	if err != nil {
+		p.logger.Errorf("OIDC discovery failed: %v", err)
+		http.Error(w, "login provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state, verifier, nonce := randToken(), randToken(), randToken()
+	p.mu.Lock()
+	p.purgePending()
+	if len(p.pending) >= maxOIDCPending {
+		p.evictPending()
+	}
+	p.pending[state] = &oidcLogin{
+		host:     host,
+		path:     r.URL.RequestURI(),
+		verifier: verifier,
+		nonce:    nonce,
+		expires:  time.Now().Add(oidcLoginTimeout),
+	}
+	p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.opts.ClientID},
+		"redirect_uri":          {p.redirectURL(r)},
+		"scope":                 {strings.Join(p.opts.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(config.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, config.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// callback handles the redirect back from the provider on the main
+// domain. hostAllowed reports whether the host the login started on is
+// still served by a tunnel.
+func (p *oidcProvider) callback(w http.ResponseWriter, r *http.Request, hostAllowed func(host string) bool) {
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, fmt.Sprintf("login failed: %s %s", e, q.Get("error_description")), http.StatusForbidden)
+		return
+	}
+
+	p.mu.Lock()
+	login, ok := p.pending[q.Get("state")]
+	delete(p.pending, q.Get("state"))
+	p.mu.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		http.Error(w, "login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	if !hostAllowed(login.host) {
+		http.Error(w, "tunnel not found", http.StatusNotFound)
+		return
+	}
+
+	sess, err := p.exchange(r.Context(), q.Get("code"), p.redirectURL(r), login)
+	if err != nil {
+		p.logger.Errorf("OIDC login for %s failed: %v", login.host, err)
+		http.Error(w, "login failed", http.StatusForbidden)
+		return
+	}
+	p.logger.Debugf("OIDC login of %s for %s", sess.Email, login.host)
+
+	sess.Expires = time.Now().Add(oidcTicketTTL).Unix()
+	ticket, err := p.sign(sess)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	u := url.URL{
+		Scheme:   requestScheme(r),
+		Host:     withPort(login.host, r.Host),
+		Path:     oidcSessionPath,
+		RawQuery: url.Values{"ticket": {ticket}, "rd": {login.path}}.Encode(),
+	}
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// session exchanges the ticket issued by callback for a session cookie
+// on the tunnel host.
+func (p *oidcProvider) session(w http.ResponseWriter, r *http.Request, host string) {
+	var sess oidcSession
+	if err := p.verify(r.URL.Query().Get("ticket"), &sess); err != nil || sess.Host != host || time.Now().Unix() >= sess.Expires {
+		http.Error(w, "invalid login ticket", http.StatusBadRequest)
+		return
+	}
+
+	sess.Expires = time.Now().Add(p.opts.SessionTTL).Unix()
+	value, err := p.sign(&sess)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(p.opts.SessionTTL.Seconds()),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	rd := r.URL.Query().Get("rd")
+	if !strings.HasPrefix(rd, "/") || strings.HasPrefix(rd, "//") {
+		rd = "/"
+	}
+	http.Redirect(w, r, rd, http.StatusFound)
+}
+
+// exchange redeems the authorization code and validates the ID token.
+// The token is received directly from the token endpoint, so TLS
+// authenticates the issuer and the signature is not checked.
+func (p *oidcProvider) exchange(ctx context.Context, code, redirectURL string, login *oidcLogin) (*oidcSession, error) {
+	config, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"client_id":     {p.opts.ClientID},
+		"client_secret": {p.opts.ClientSecret},
+		"code_verifier": {login.verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+	parts := strings.Split(token.IDToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed id token: %v", err)
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, fmt.Errorf("malformed id token: %v", err)
+	}
+
+	if claims["iss"] != config.Issuer {
+		return nil, fmt.Errorf("id token issued by %v, expected %s", claims["iss"], config.Issuer)
+	}
+	if !slices.Contains(stringList(claims["aud"]), p.opts.ClientID) {
+		return nil, errors.New("id token not issued for this client")
+	}
+	if exp, _ := claims["exp"].(float64); time.Now().Unix() >= int64(exp) {
+		return nil, errors.New("id token expired")
+	}
+	if claims["nonce"] != login.nonce {
+		return nil, errors.New("id token nonce mismatch")
+	}
+
+	sess := &oidcSession{Host: login.host, Groups: stringList(claims[p.opts.GroupsClaim])}
+	sess.Email, _ = claims["email"].(string)
+	// Addresses not explicitly verified don't pass domain allowlists.
+	sess.EmailVerified, _ = claims["email_verified"].(bool)
+	return sess, nil
+}
+
+// discover fetches the provider configuration once.
+func (p *oidcProvider) discover(ctx context.Context) (*oidcConfig, error) {
+	p.mu.Lock()
+	config := p.config
+	p.mu.Unlock()
+	if config != nil {
+		return config, nil
+	}
+
+	u := strings.TrimSuffix(p.opts.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+
+	config = &oidcConfig{}
+	if err := json.NewDecoder(resp.Body).Decode(config); err != nil {
+		return nil, err
+	}
+	if config.Issuer != p.opts.Issuer {
+		return nil, fmt.Errorf("provider issuer %q does not match %q", config.Issuer, p.opts.Issuer)
+	}
+
+	p.mu.Lock()
+	p.config = config
+	p.mu.Unlock()
+	return config, nil
+}
+
+// redirectURL returns the callback URL registered with the provider.
+func (p *oidcProvider) redirectURL(r *http.Request) string {
+	if p.opts.RedirectURL != "" {
+		return p.opts.RedirectURL
+	}
+	u := url.URL{Scheme: requestScheme(r), Host: withPort(p.domain, r.Host), Path: oidcCallbackPath}
+	return u.String()
+}
+
+// sign returns the session JSON encoded with HMAC signature appended.
+func (p *oidcProvider) sign(sess *oidcSession) (string, error) {
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write(data)
+	return base64.RawURLEncoding.EncodeToString(data) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verify checks the signature of value created by sign and decodes it
+// into sess.
+func (p *oidcProvider) verify(value string, sess *oidcSession) error {
+	payload, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return errors.New("malformed session")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return err
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write(data)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return errors.New("invalid session signature")
+	}
+	return json.Unmarshal(data, sess)
+}
+
+// purgePending removes expired logins. It must be called with p.mu held.
+func (p *oidcProvider) purgePending() {
+	now := time.Now()
+	for state, login := range p.pending {
+		if now.After(login.expires) {
+			delete(p.pending, state)
+		}
+	}
+}
+
+// evictPending removes the oldest login. It must be called with p.mu
+// held.
+func (p *oidcProvider) evictPending() {
+	var oldest string
+	for state, login := range p.pending {
+		if oldest == "" || login.expires.Before(p.pending[oldest].expires) {
+			oldest = state
+		}
+	}
+	delete(p.pending, oldest)
+}
+
+// removeCookie removes the named cookie from the request headers, so it
+// is not forwarded to the tunnel.
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != name {
+			r.AddCookie(c)
+		}
+	}
+}
+
+func randToken() string {
+	b := make([]byte, 24)
+	crand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// withPort returns host with the port of reqHost, if it has one.
+func withPort(host, reqHost string) string {
+	if _, port, err := net.SplitHostPort(reqHost); err == nil {
+		return net.JoinHostPort(host, port)
+	}
+	return host
+}
+
+// stringList converts a JSON claim holding a string or list of strings.
+func stringList(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
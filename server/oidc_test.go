@@ -0,0 +1,318 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// mockIssuer is an OIDC provider serving discovery, JWKS, authorization
+// and token endpoints. Authorization succeeds right away with the claims
+// set on the issuer.
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	claims map[string]any
+	codes  map[string]mockCode
+}
+
+// mockCode is an authorization code issued by the mock.
+type mockCode struct {
+	nonce       string
+	challenge   string
+	redirectURI string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key, codes: make(map[string]mockCode)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("GET /authorize", m.authorize)
+	mux.HandleFunc("POST /token", m.token)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockIssuer) setClaims(claims map[string]any) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.claims = claims
+}
+
+func (m *mockIssuer) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != "bore" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	code := randToken()
+	m.mu.Lock()
+	m.codes[code] = mockCode{q.Get("nonce"), q.Get("code_challenge"), q.Get("redirect_uri")}
+	m.mu.Unlock()
+
+	u, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u.RawQuery = url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	code, ok := m.codes[r.PostFormValue("code")]
+	delete(m.codes, r.PostFormValue("code"))
+	claims := m.claims
+	m.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	switch {
+	case !ok, r.PostFormValue("grant_type") != "authorization_code":
+		writeJSONError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	case r.PostFormValue("client_id") != "bore", r.PostFormValue("client_secret") != "s3cret":
+		writeJSONError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	case base64.RawURLEncoding.EncodeToString(challenge[:]) != code.challenge, r.PostFormValue("redirect_uri") != code.redirectURI:
+		writeJSONError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	payload := map[string]any{
+		"iss":   m.URL,
+		"sub":   "user-1",
+		"aud":   "bore",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": code.nonce,
+	}
+	for k, v := range claims {
+		payload[k] = v
+	}
+	idToken, err := m.sign(payload)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": randToken(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// sign returns claims as RS256 signed JWT.
+func (m *mockIssuer) sign(claims map[string]any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func newTestOIDCProvider(t *testing.T, issuer string) *oidcProvider {
+	t.Helper()
+	p, err := newOIDCProvider(OIDC{
+		Issuer:       issuer,
+		ClientID:     "bore",
+		ClientSecret: "s3cret",
+		Scopes:       []string{"openid", "email"},
+		GroupsClaim:  "groups",
+		SessionTTL:   time.Hour,
+	}, "bore.test", zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// location returns the redirect target of the recorded response.
+func location(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	if w.Code != http.StatusFound {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusFound, w.Body.String())
+	}
+	return w.Header().Get("Location")
+}
+
+// loginFlow runs the login flow of a visitor of host up to the session
+// cookie set on the tunnel host.
+func loginFlow(t *testing.T, p *oidcProvider, host string, access *tunnelOIDC) *http.Cookie {
+	t.Helper()
+
+	// The visitor without session is sent to the provider.
+	w := httptest.NewRecorder()
+	if _, ok := p.authorize(w, httptest.NewRequest(http.MethodGet, "http://"+host+"/app?x=1", nil), host, access); ok {
+		t.Fatal("request without session was let through")
+	}
+	authURL := location(t, w)
+
+	// The provider redirects back to the callback on the main domain.
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorization endpoint returned %s", resp.Status)
+	}
+	callbackURL := resp.Header.Get("Location")
+	if u, _ := url.Parse(callbackURL); u.Host != "bore.test" || u.Path != oidcCallbackPath {
+		t.Fatalf("redirected to %s, want callback on main domain", callbackURL)
+	}
+
+	// The callback hands the login over to the tunnel host.
+	w = httptest.NewRecorder()
+	p.callback(w, httptest.NewRequest(http.MethodGet, callbackURL, nil), func(h string) bool { return h == host })
+	sessionURL := location(t, w)
+	if u, _ := url.Parse(sessionURL); u.Host != host || u.Path != oidcSessionPath {
+		t.Fatalf("redirected to %s, want session path on %s", sessionURL, host)
+	}
+
+	// The tunnel host sets the session cookie and returns to the page.
+	w = httptest.NewRecorder()
+	p.session(w, httptest.NewRequest(http.MethodGet, sessionURL, nil), host)
+	if rd := location(t, w); rd != "/app?x=1" {
+		t.Fatalf("redirected to %s after login, want /app?x=1", rd)
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcCookie {
+			return c
+		}
+	}
+	t.Fatal("no session cookie set")
+	return nil
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newMockIssuer(t)
+	p := newTestOIDCProvider(t, issuer.URL)
+
+	tests := []struct {
+		name    string
+		claims  map[string]any
+		domains string
+		groups  string
+		allowed bool
+	}{
+		{"any user", map[string]any{"email": "bob@other.test"}, "", "", true},
+		{"verified email in domain", map[string]any{"email": "alice@Example.com", "email_verified": true}, "example.com", "", true},
+		{"email not verified", map[string]any{"email": "alice@example.com", "email_verified": false}, "example.com", "", false},
+		{"email verification not stated", map[string]any{"email": "alice@example.com"}, "example.com", "", false},
+		{"email in other domain", map[string]any{"email": "bob@other.test", "email_verified": true}, "example.com", "", false},
+		{"group member", map[string]any{"email": "bob@other.test", "groups": []string{"dev", "ops"}}, "example.com", "ops", true},
+		{"not group member", map[string]any{"email": "bob@other.test", "groups": "dev"}, "", "ops", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer.setClaims(tt.claims)
+			access := newTunnelOIDC(setOIDCPayload{tt.domains, tt.groups})
+			cookie := loginFlow(t, p, "app.bore.test", access)
+
+			r := httptest.NewRequest(http.MethodGet, "http://app.bore.test/app", nil)
+			r.AddCookie(cookie)
+			w := httptest.NewRecorder()
+			sess, ok := p.authorize(w, r, "app.bore.test", access)
+			if ok != tt.allowed {
+				t.Fatalf("authorized %v, want %v (status %d)", ok, tt.allowed, w.Code)
+			}
+			if !ok && w.Code != http.StatusForbidden {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusForbidden)
+			}
+			if ok && sess.Email != tt.claims["email"] {
+				t.Fatalf("session email %q, want %q", sess.Email, tt.claims["email"])
+			}
+		})
+	}
+}
+
+func TestOIDCSessionScopedToHost(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.setClaims(map[string]any{"email": "bob@other.test"})
+	p := newTestOIDCProvider(t, issuer.URL)
+	cookie := loginFlow(t, p, "app.bore.test", &tunnelOIDC{})
+
+	r := httptest.NewRequest(http.MethodGet, "http://other.bore.test/", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	if _, ok := p.authorize(w, r, "other.bore.test", &tunnelOIDC{}); ok {
+		t.Fatal("session of another host was accepted")
+	}
+	if w.Code != http.StatusFound {
+		t.Fatalf("got status %d, want redirect to login", w.Code)
+	}
+}
+
+func TestOIDCCallbackUnknownState(t *testing.T) {
+	issuer := newMockIssuer(t)
+	p := newTestOIDCProvider(t, issuer.URL)
+
+	w := httptest.NewRecorder()
+	p.callback(w, httptest.NewRequest(http.MethodGet, "http://bore.test/oidc/callback?code=x&state=unknown", nil), func(string) bool { return true })
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestOIDCPendingLimit(t *testing.T) {
+	issuer := newMockIssuer(t)
+	p := newTestOIDCProvider(t, issuer.URL)
+
+	for i := 0; i < maxOIDCPending+10; i++ {
+		p.login(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://app.bore.test/", nil), "app.bore.test")
+	}
+	if n := len(p.pending); n != maxOIDCPending {
+		t.Fatalf("%d logins pending, want %d", n, maxOIDCPending)
+	}
+}
@@ -5,22 +5,104 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/go-viper/mapstructure/v2"
 	"github.com/jkuri/bore/pkg/fs"
 	"github.com/jkuri/bore/pkg/logger"
 	"github.com/jkuri/bore/pkg/rsa"
 	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/acme"
 )
 
 // Options are global config for bore server.
 type Options struct {
-	Domain     string
-	PrivateKey string
-	PublicKey  string
-	SSHAddr    string
-	HTTPAddr   string
-	Logger     *logger.Options
+	Domain            string
+	PrivateKey        string
+	PublicKey         string
+	AuthorizedKeys    string
+	TrustedUserCAKeys string
+	Reservations      []Reservation
+	Tokens            []Token
+	ResumeGrace       time.Duration
+	SSHAddr           string
+	HTTPAddr          string
+	HTTPSAddr         string
+	PassthroughAddr   string
+	MetricsAddr       string        // address Prometheus metrics are served on, disabled if empty
+	HistoryFile       string        // file traffic history is persisted to, kept in memory only if empty
+	PublicPorts       bool          // whether tunnel ports accept TCP connections from anywhere
+	UDPIdleTimeout    time.Duration // how long UDP peers are remembered without traffic
+	TLSCert           string
+	TLSKey            string
+	ACME              ACME
+	OIDC              OIDC
+	Admin             Admin
+	CustomDomains     bool
+	Resolver          string   // DNS server used to verify custom domains, system resolver if empty
+	AllowIPs          []string // CIDRs allowed to reach tunnels, all if empty
+	DenyIPs           []string // CIDRs refused access to tunnels
+	TrustedProxies    []string // CIDRs of proxies whose X-Forwarded-For is trusted
+	Logger            *logger.Options
+}
+
+// Reservation binds tunnel IDs to the key with given fingerprint.
+// IDs may contain shell patterns as accepted by path.Match, e.g. "pr-*".
+type Reservation struct {
+	Fingerprint string
+	IDs         []string
+}
+
+// Token is a pre-shared API token clients may authenticate with
+// instead of an SSH key. Expires is optional and IDs optionally
+// restricts which tunnel IDs the token holder may claim.
+type Token struct {
+	Name    string
+	Token   string
+	Expires time.Time
+	IDs     []string
+}
+
+// ACME configures obtaining certificates from an ACME CA such as
+// Let's Encrypt. If DNSCommand or Provider is set, a wildcard
+// certificate for the domain is obtained via DNS-01. Otherwise each
+// host gets its own certificate on first request.
+type ACME struct {
+	Enabled          bool
+	Email            string
+	Directory        string        // ACME directory URL
+	CARoots          string        // PEM file with roots trusted for Directory, e.g. Pebble's CA
+	Cache            string        // directory certificates are stored in
+	DNSCommand       string        // command called to present and clean up DNS-01 records
+	PropagationDelay time.Duration // time to wait for DNS records to propagate
+	Provider         DNSProvider   `mapstructure:"-"`
+}
+
+// OIDC configures the OpenID Connect provider clients can require
+// visitors to log in with before accessing their tunnels. The provider
+// must allow RedirectURL, which defaults to <scheme>://<domain>/oidc/callback.
+type OIDC struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	GroupsClaim  string // ID token claim listing the user's groups
+	RedirectURL  string
+	SessionKey   string        // key signing session cookies, random if empty
+	SessionTTL   time.Duration // how long the login is valid
+}
+
+// Admin configures the admin API, served on its own address. Requests
+// must carry Token as bearer token, a client certificate signed by
+// ClientCA, or both if both are set. TLSCert and TLSKey are served when
+// ClientCA is set.
+type Admin struct {
+	Addr     string
+	Token    string
+	ClientCA string
+	TLSCert  string
+	TLSKey   string
 }
 
 // NewConfig returns viper config.
@@ -35,8 +117,44 @@ func NewConfig(configPath string) (*viper.Viper, error) {
 	v.SetDefault("domain", "bore.digital")
 	v.SetDefault("privatekey", filepath.Join(dir, "id_rsa"))
 	v.SetDefault("publickey", filepath.Join(dir, "id_rsa.pub"))
+	v.SetDefault("authorizedkeys", "")
+	v.SetDefault("trustedusercakeys", "")
+	v.SetDefault("resumegrace", "1m")
 	v.SetDefault("sshaddr", "0.0.0.0:2200")
 	v.SetDefault("httpaddr", "0.0.0.0:2000")
+	v.SetDefault("httpsaddr", "")
+	v.SetDefault("passthroughaddr", "")
+	v.SetDefault("metricsaddr", "")
+	v.SetDefault("historyfile", filepath.Join(dir, "history.json"))
+	v.SetDefault("publicports", true)
+	v.SetDefault("udpidletimeout", "2m")
+	v.SetDefault("tlscert", "")
+	v.SetDefault("tlskey", "")
+	v.SetDefault("customdomains", true)
+	v.SetDefault("resolver", "")
+	v.SetDefault("allowips", []string{})
+	v.SetDefault("denyips", []string{})
+	v.SetDefault("trustedproxies", []string{})
+	v.SetDefault("oidc.issuer", "")
+	v.SetDefault("oidc.clientid", "")
+	v.SetDefault("oidc.clientsecret", "")
+	v.SetDefault("oidc.scopes", []string{"openid", "email", "profile"})
+	v.SetDefault("oidc.groupsclaim", "groups")
+	v.SetDefault("oidc.redirecturl", "")
+	v.SetDefault("oidc.sessionkey", "")
+	v.SetDefault("oidc.sessionttl", "12h")
+	v.SetDefault("admin.addr", "")
+	v.SetDefault("admin.token", "")
+	v.SetDefault("admin.clientca", "")
+	v.SetDefault("admin.tlscert", "")
+	v.SetDefault("admin.tlskey", "")
+	v.SetDefault("acme.enabled", false)
+	v.SetDefault("acme.email", "")
+	v.SetDefault("acme.directory", acme.LetsEncryptURL)
+	v.SetDefault("acme.caroots", "")
+	v.SetDefault("acme.cache", filepath.Join(dir, "acme"))
+	v.SetDefault("acme.dnscommand", "")
+	v.SetDefault("acme.propagationdelay", "0s")
 	v.SetDefault("log.level", "debug")
 	v.SetDefault("log.stdout", true)
 	v.SetDefault("log.filename", filepath.Join(dir, "bore-server.log"))
@@ -75,11 +193,60 @@ func NewOptions(v *viper.Viper) (*Options, error) {
 	if err := v.ReadInConfig(); err != nil {
 		return nil, err
 	}
-	err := v.Unmarshal(opts)
+	err := v.Unmarshal(opts, viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		mapstructure.StringToTimeHookFunc(time.RFC3339),
+	)))
 	if err != nil {
 		return nil, err
 	}
 
+	for _, r := range opts.Reservations {
+		for _, pattern := range r.IDs {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid reserved id pattern %q: %v", pattern, err)
+			}
+		}
+	}
+
+	for _, t := range opts.Tokens {
+		if t.Name == "" || t.Token == "" {
+			return nil, fmt.Errorf("token must have name and token set")
+		}
+		for _, pattern := range t.IDs {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid id pattern %q for token %q: %v", pattern, t.Name, err)
+			}
+		}
+	}
+
+	if opts.HTTPSAddr != "" && !opts.ACME.Enabled && (opts.TLSCert == "" || opts.TLSKey == "") {
+		return nil, fmt.Errorf("httpsaddr requires tlscert and tlskey to be set or acme to be enabled")
+	}
+	if _, err := newIPFilter(opts.AllowIPs, opts.DenyIPs); err != nil {
+		return nil, err
+	}
+	if _, err := parsePrefixes(opts.TrustedProxies); err != nil {
+		return nil, err
+	}
+	if opts.UDPIdleTimeout <= 0 {
+		return nil, fmt.Errorf("udpidletimeout must be positive")
+	}
+
+	if opts.OIDC.Issuer != "" && opts.OIDC.ClientID == "" {
+		return nil, fmt.Errorf("oidc requires clientid to be set")
+	}
+	if opts.ACME.Enabled && opts.HTTPSAddr == "" {
+		return nil, fmt.Errorf("acme requires httpsaddr to be set")
+	}
+	if opts.Admin.Addr != "" && opts.Admin.Token == "" && opts.Admin.ClientCA == "" {
+		return nil, fmt.Errorf("admin.addr requires admin.token or admin.clientca to be set")
+	}
+	if opts.Admin.ClientCA != "" && (opts.Admin.TLSCert == "" || opts.Admin.TLSKey == "") {
+		return nil, fmt.Errorf("admin.clientca requires admin.tlscert and admin.tlskey to be set")
+	}
+
 	rsa.GenerateRSA(opts.PrivateKey, opts.PublicKey)
 
 	return opts, nil
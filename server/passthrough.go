@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// errHelloRead aborts the handshake once the ClientHello is parsed.
+var errHelloRead = errors.New("client hello read")
+
+// runPassthrough accepts TLS connections on addr and forwards them
+// undecrypted to the tunnel matching the SNI server name, so the local
+// service terminates TLS itself.
+func (s *BoreServer) runPassthrough(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.httpServer.logger.Infof("starting TLS passthrough server on %s", addr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			var neterr net.Error
+			if errors.As(err, &neterr) && neterr.Timeout() {
+				continue
+			}
+			return err
+		}
+		go s.handlePassthrough(conn)
+	}
+}
+
+func (s *BoreServer) handlePassthrough(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	hello, r, err := peekClientHello(conn)
+	if err != nil {
+		s.httpServer.logger.Debugf("TLS passthrough from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	host := normalizeHost(hello.ServerName)
+	if host == "" || host == s.opts.Domain {
+		s.httpServer.logger.Debugf("TLS passthrough from %s: no tunnel for server name %q", conn.RemoteAddr(), host)
+		conn.Close()
+		return
+	}
+	id := s.tunnelID(host)
+
+	s.sshServer.mu.Lock()
+	t, ok := s.sshServer.tunnels[id]
+	s.sshServer.mu.Unlock()
+	if !ok || t.udp != nil {
+		s.httpServer.logger.Debugf("TLS passthrough from %s: no tunnel for server name %q", conn.RemoteAddr(), host)
+		conn.Close()
+		return
+	}
+
+	if !s.sshServer.allows(t, connAddr(conn)) {
+		s.httpServer.logger.Debugf("[%s] TLS passthrough from %s refused by IP filter", t.id, conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	if t.protected() {
+		s.httpServer.logger.Debugf("[%s] TLS passthrough from %s refused, tunnel requires HTTP auth", t.id, conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	bindInfo := &bindInfo{Bound: t.bind, Addr: t.addr, Port: t.port}
+	s.sshServer.handleForwardTCPIP(t, bindInfo, &peekedConn{conn, r})
+}
+
+// peekedConn is a connection whose already read bytes are replayed
+// before reading from the connection.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// peekClientHello parses the TLS ClientHello read from r. It returns
+// a reader yielding all data of r, including the ClientHello.
+func peekClientHello(r io.Reader) (*tls.ClientHelloInfo, io.Reader, error) {
+	peeked := new(bytes.Buffer)
+	var hello *tls.ClientHelloInfo
+
+	err := tls.Server(readOnlyConn{io.TeeReader(r, peeked)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = new(tls.ClientHelloInfo)
+			*hello = *h
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if hello == nil {
+		return nil, nil, err
+	}
+
+	return hello, io.MultiReader(peeked, r), nil
+}
+
+// readOnlyConn lets tls.Server read the ClientHello without writing
+// anything back to the client.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// latencyBuckets are upper bounds in seconds of the proxy latency
+// histogram, same as Prometheus client defaults.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram is a cumulative Prometheus histogram, guarded by MetricsHub.mu.
+type histogram struct {
+	counts []uint64 // per bucket of latencyBuckets, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// RecordResponse counts an HTTP response with given status code. For
+// requests proxied to a tunnel the duration is added to the latency
+// histogram.
+func (h *MetricsHub) RecordResponse(code int, d time.Duration, proxied bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.httpResponses[code]++
+	if proxied {
+		h.proxyLatency.observe(d.Seconds())
+	}
+}
+
+// RecordHandshakeFailure counts a failed SSH handshake.
+func (h *MetricsHub) RecordHandshakeFailure() {
+	h.handshakeFailures.Add(1)
+}
+
+// HandlePrometheus serves metrics in the Prometheus text exposition
+// format.
+func (h *MetricsHub) HandlePrometheus(w http.ResponseWriter, r *http.Request) {
+	var tunnels, channels int
+	h.sshServer.mu.Lock()
+	for _, t := range h.sshServer.tunnels {
+		tunnels++
+		t.client.mu.Lock()
+		channels += len(t.channels)
+		t.client.mu.Unlock()
+	}
+	h.sshServer.mu.Unlock()
+
+	// Per tunnel counters come from history, which keeps them by ID
+	// across reconnects.
+	perTunnel := h.history.totals()
+
+	h.mu.RLock()
+	stats := h.serverStats
+	codes := make([]int, 0, len(h.httpResponses))
+	responses := make(map[int]uint64, len(h.httpResponses))
+	for code, n := range h.httpResponses {
+		codes = append(codes, code)
+		responses[code] = n
+	}
+	latency := *h.proxyLatency
+	latency.counts = append([]uint64(nil), h.proxyLatency.counts...)
+	h.mu.RUnlock()
+
+	sort.Ints(codes)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	writeMetricHeader(bw, "bore_bytes_received_total", "counter", "Bytes received from visitors on all tunnels.")
+	fmt.Fprintf(bw, "bore_bytes_received_total %d\n", stats.CumulativeBytesIn)
+	writeMetricHeader(bw, "bore_bytes_sent_total", "counter", "Bytes sent to visitors on all tunnels.")
+	fmt.Fprintf(bw, "bore_bytes_sent_total %d\n", stats.CumulativeBytesOut)
+
+	writeMetricHeader(bw, "bore_tunnel_bytes_received_total", "counter", "Bytes received from visitors per tunnel ID.")
+	for _, t := range perTunnel {
+		fmt.Fprintf(bw, "bore_tunnel_bytes_received_total{tunnel=%s} %d\n", quoteLabel(t.ID), t.BytesIn)
+	}
+	writeMetricHeader(bw, "bore_tunnel_bytes_sent_total", "counter", "Bytes sent to visitors per tunnel ID.")
+	for _, t := range perTunnel {
+		fmt.Fprintf(bw, "bore_tunnel_bytes_sent_total{tunnel=%s} %d\n", quoteLabel(t.ID), t.BytesOut)
+	}
+
+	writeMetricHeader(bw, "bore_tunnels_active", "gauge", "Number of open tunnels.")
+	fmt.Fprintf(bw, "bore_tunnels_active %d\n", tunnels)
+	writeMetricHeader(bw, "bore_channels_active", "gauge", "Number of open forwarded connections.")
+	fmt.Fprintf(bw, "bore_channels_active %d\n", channels)
+
+	writeMetricHeader(bw, "bore_ssh_handshake_failures_total", "counter", "Number of failed SSH handshakes.")
+	fmt.Fprintf(bw, "bore_ssh_handshake_failures_total %d\n", h.handshakeFailures.Load())
+
+	writeMetricHeader(bw, "bore_http_responses_total", "counter", "HTTP responses by status code.")
+	for _, code := range codes {
+		fmt.Fprintf(bw, "bore_http_responses_total{code=\"%d\"} %d\n", code, responses[code])
+	}
+
+	writeMetricHeader(bw, "bore_http_proxy_duration_seconds", "histogram", "Duration of HTTP requests proxied to tunnels.")
+	var cumulative uint64
+	for i, le := range latencyBuckets {
+		cumulative += latency.counts[i]
+		fmt.Fprintf(bw, "bore_http_proxy_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(bw, "bore_http_proxy_duration_seconds_bucket{le=\"+Inf\"} %d\n", latency.count)
+	fmt.Fprintf(bw, "bore_http_proxy_duration_seconds_sum %s\n", strconv.FormatFloat(latency.sum, 'g', -1, 64))
+	fmt.Fprintf(bw, "bore_http_proxy_duration_seconds_count %d\n", latency.count)
+}
+
+func writeMetricHeader(w *bufio.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
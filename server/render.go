@@ -1,7 +1,6 @@
 package server
 
 import (
-	"fmt"
 	"io"
 
 	"github.com/charmbracelet/lipgloss"
@@ -29,9 +28,14 @@ func renderTable(data clientResponse, w io.Writer) {
 	)
 
 	rows := [][]string{
-		{"HTTP", fmt.Sprintf("http://%s.%s", data.id, data.domain)},
-		{"HTTPS", fmt.Sprintf("https://%s.%s", data.id, data.domain)},
-		{"TCP", fmt.Sprintf("tcp://%s:%d", data.domain, data.port)},
+		{"HTTP", data.httpURL()},
+		{"HTTPS", data.httpsURL()},
+	}
+	if addr := data.tcpAddr(); addr != "" {
+		rows = append(rows, []string{"TCP", "tcp://" + addr})
+	}
+	if data.udp {
+		rows = [][]string{{"UDP", "udp://" + data.tcpAddr()}}
 	}
 
 	t := table.New().
@@ -0,0 +1,193 @@
+package server
+
+import (
+	crand "crypto/rand"
+	"fmt"
+	"time"
+)
+
+// resumeEntry keeps ID and port of a tunnel for the client holding its
+// resume token. It is recorded when the token is issued and holds the
+// ID and port once the connection drops, so the client reconnecting
+// within the grace period gets them back.
+type resumeEntry struct {
+	id      string
+	port    uint32
+	udp     bool // port is a UDP port
+	owner   string
+	tunnel  *tunnel   // open tunnel the token was issued for, nil once held
+	expires time.Time // end of the hold, zero while the tunnel is open
+}
+
+// issueResumeToken returns token the client can use to resume the
+// tunnel after reconnect. Resuming is disabled if ResumeGrace is zero.
+func (s *SSHServer) issueResumeToken(t *tunnel) (string, error) {
+	if s.opts.ResumeGrace <= 0 {
+		return "", fmt.Errorf("resuming tunnels is disabled")
+	}
+
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	token := fmt.Sprintf("%x", b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tunnels[t.id] != t {
+		return "", fmt.Errorf("tunnel is closed")
+	}
+
+	t.client.mu.Lock()
+	delete(s.resumable, t.resumeToken)
+	t.resumeToken = token
+	t.client.mu.Unlock()
+
+	s.resumable[token] = &resumeEntry{
+		id:     t.id,
+		port:   t.port,
+		udp:    t.udp != nil,
+		owner:  t.client.owner(),
+		tunnel: t,
+	}
+	return token, nil
+}
+
+// holdTunnel keeps the tunnel ID and port for the grace period if the
+// client was issued a resume token.
+func (s *SSHServer) holdTunnel(t *tunnel) {
+	t.client.mu.Lock()
+	token := t.resumeToken
+	t.client.mu.Unlock()
+	if token == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.purgeResumable()
+	entry, ok := s.resumable[token]
+	if !ok || entry.tunnel != t {
+		// Already resumed by the reconnected client.
+		return
+	}
+	entry.tunnel = nil
+	entry.expires = time.Now().Add(s.opts.ResumeGrace)
+	s.logger.Debugf("[%s] holding tunnel for %s", t.id, s.opts.ResumeGrace)
+}
+
+// resume claims the tunnel for given token. The ID is assigned to the
+// next tunnel the client opens. The client may notice a dropped
+// connection before the server does, in which case the tunnel is still
+// open and its stale connection is closed.
+func (s *SSHServer) resume(c *client, token string) (*resumeEntry, error) {
+	s.mu.Lock()
+	s.purgeResumable()
+	entry, ok := s.resumable[token]
+	var err error
+	switch {
+	case !ok:
+		err = fmt.Errorf("unknown or expired resume token")
+	case entry.owner != c.owner():
+		err = fmt.Errorf("resume token was issued to another owner")
+	case entry.tunnel != nil && entry.tunnel.client == c:
+		err = fmt.Errorf("tunnel is open on this connection")
+	}
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	stale := entry.tunnel
+	if stale != nil {
+		// Hold the ID and port while the stale tunnel is closed.
+		entry.tunnel = nil
+		entry.expires = time.Now().Add(s.opts.ResumeGrace)
+	}
+	s.mu.Unlock()
+
+	if stale != nil {
+		s.logger.Infof("[%s] closing stale connection of resumed tunnel", stale.id)
+		stale.client.sshConn.Close()
+		s.closeTunnel(stale)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, taken := s.tunnels[entry.id]; taken {
+		return nil, fmt.Errorf("id %q is already in use", entry.id)
+	}
+	delete(s.resumable, token)
+	c.nextID = entry.id
+	return entry, nil
+}
+
+// held reports whether the ID is held for a reconnecting client.
+// It must be called with s.mu held.
+func (s *SSHServer) held(id string) bool {
+	now := time.Now()
+	for _, entry := range s.resumable {
+		if entry.id == id && now.Before(entry.expires) {
+			return true
+		}
+	}
+	return false
+}
+
+// claimHeld releases the hold on the ID if it is held for the owner,
+// so a client restarted without its resume token gets the ID back. An
+// anonymous client never claims held IDs this way. It
+// reports whether the ID is held for another owner. It must be called
+// with s.mu held.
+func (s *SSHServer) claimHeld(id, owner string) bool {
+	now := time.Now()
+	for _, entry := range s.resumable {
+		if entry.id == id && !sameOwner(entry.owner, owner) && now.Before(entry.expires) {
+			return true
+		}
+	}
+	for token, entry := range s.resumable {
+		if entry.id == id && entry.tunnel == nil {
+			delete(s.resumable, token)
+		}
+	}
+	return false
+}
+
+// heldPort returns owner of the tunnel holding the TCP or UDP port for
+// a reconnecting client. It must be called with s.mu held.
+func (s *SSHServer) heldPort(port uint32, udp bool) (string, bool) {
+	now := time.Now()
+	for _, entry := range s.resumable {
+		if entry.port == port && entry.udp == udp && now.Before(entry.expires) {
+			return entry.owner, true
+		}
+	}
+	return "", false
+}
+
+// portAvailable reports whether the client may bind the port. Random
+// ports skip all held ports, while a port requested explicitly is only
+// refused if it is held for another owner.
+func (s *SSHServer) portAvailable(c *client, port uint32, udp, random bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	owner, held := s.heldPort(port, udp)
+	return !held || (!random && sameOwner(owner, c.owner()))
+}
+
+// sameOwner reports whether owners a and b are the same. Anonymous
+// clients have no owner and only reclaim holds with their resume token.
+func sameOwner(a, b string) bool {
+	return a != "" && a == b
+}
+
+// purgeResumable removes expired holds. It must be called with s.mu held.
+func (s *SSHServer) purgeResumable() {
+	now := time.Now()
+	for token, entry := range s.resumable {
+		if entry.tunnel == nil && !now.Before(entry.expires) {
+			delete(s.resumable, token)
+		}
+	}
+}
@@ -1,12 +1,18 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/dustin/go-humanize"
 	"github.com/felixge/httpsnoop"
@@ -15,6 +21,7 @@ import (
 	"github.com/jkuri/statik/fs"
 	"github.com/yhat/wsutil"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
 )
 
 // ProviderSet exports for wire DI.
@@ -27,15 +34,24 @@ var ProviderSet = wire.NewSet(
 // BoreServer defines main struct for bore server and
 // includes HTTP and SSH server instances.
 type BoreServer struct {
-	opts       *Options
-	sshServer  *SSHServer
-	httpServer *HTTPServer
-	metricsHub *MetricsHub
-	UI         http.Handler
+	opts        *Options
+	sshServer   *SSHServer
+	httpServer  *HTTPServer
+	httpsServer *HTTPServer
+	adminServer *HTTPServer
+	promServer  *HTTPServer
+	certificate *certificate
+	acme        *acmeManager
+	oidc        *oidcProvider
+
+	trustedProxies []netip.Prefix
+	metricsHub     *MetricsHub
+	captures       *harCaptures // HTTP requests recorded on admin request
+	UI             http.Handler
 }
 
 // NewBoreServer returns new instance of BoreServer.
-func NewBoreServer(opts *Options, logger *zap.Logger) *BoreServer {
+func NewBoreServer(opts *Options, logger *zap.Logger) (*BoreServer, error) {
 	log := logger.Sugar()
 	landingFS, _ := fs.New()
 
@@ -43,25 +59,130 @@ func NewBoreServer(opts *Options, logger *zap.Logger) *BoreServer {
 	metricsHub := NewMetricsHub(sshServer, log)
 	sshServer.metricsHub = metricsHub
 
-	return &BoreServer{
+	s := &BoreServer{
 		opts:       opts,
 		sshServer:  sshServer,
 		httpServer: NewHTTPServer(log),
 		metricsHub: metricsHub,
+		captures:   newHARCaptures(),
 		UI:         http.FileServer(&statikWrapper{landingFS}),
 	}
+	if opts.HTTPSAddr != "" {
+		s.httpsServer = NewHTTPServer(log)
+		if opts.ACME.Enabled {
+			m, err := newACMEManager(opts.ACME, opts.Domain, s.allowCertificate, log)
+			if err != nil {
+				return nil, err
+			}
+			s.acme = m
+		} else {
+			s.certificate = newCertificate(opts.TLSCert, opts.TLSKey, log)
+		}
+	}
+
+	if opts.Admin.Addr != "" {
+		s.adminServer = NewHTTPServer(log)
+	}
+	if opts.MetricsAddr != "" {
+		s.promServer = NewHTTPServer(log)
+	}
+
+	// Lists are validated by NewOptions.
+	s.trustedProxies, _ = parsePrefixes(opts.TrustedProxies)
+
+	if opts.OIDC.Issuer != "" {
+		p, err := newOIDCProvider(opts.OIDC, opts.Domain, log)
+		if err != nil {
+			return nil, err
+		}
+		s.oidc = p
+	}
+
+	return s, nil
 }
 
 // Run starts the bore server.
 func (s *BoreServer) Run() error {
 	errch := make(chan error)
 
+	handler := s.getHandler(s.handleHTTP())
+	if s.acme != nil {
+		handler = s.acme.HTTPHandler(handler)
+	}
+
 	go func() {
-		if err := s.httpServer.Run(s.opts.HTTPAddr, s.getHandler(s.handleHTTP())); err != nil {
+		if err := s.httpServer.Run(s.opts.HTTPAddr, handler); err != nil {
 			errch <- err
 		}
 	}()
 
+	if s.httpsServer != nil {
+		tlsConfig := &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		}
+		if s.acme != nil {
+			if err := s.acme.run(context.Background()); err != nil {
+				return err
+			}
+			tlsConfig.GetCertificate = s.acme.GetCertificate
+			tlsConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+		} else {
+			if err := s.certificate.load(); err != nil {
+				return err
+			}
+			tlsConfig.GetCertificate = s.certificate.GetCertificate
+		}
+
+		go func() {
+			if err := s.httpsServer.RunTLS(s.opts.HTTPSAddr, s.getHandler(s.handleHTTP()), tlsConfig); err != nil {
+				errch <- err
+			}
+		}()
+
+		go func() {
+			if err := s.httpsServer.Wait(); err != nil {
+				errch <- err
+			}
+		}()
+	}
+
+	if s.opts.PassthroughAddr != "" {
+		go func() {
+			errch <- s.runPassthrough(s.opts.PassthroughAddr)
+		}()
+	}
+
+	if s.promServer != nil {
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /metrics", s.metricsHub.HandlePrometheus)
+
+		go func() {
+			if err := s.promServer.Run(s.opts.MetricsAddr, mux); err != nil {
+				errch <- err
+			}
+		}()
+
+		go func() {
+			if err := s.promServer.Wait(); err != nil {
+				errch <- err
+			}
+		}()
+	}
+
+	if s.adminServer != nil {
+		go func() {
+			if err := s.runAdmin(); err != nil {
+				errch <- err
+			}
+		}()
+
+		go func() {
+			if err := s.adminServer.Wait(); err != nil {
+				errch <- err
+			}
+		}()
+	}
+
 	go func() {
 		if err := s.sshServer.Run(); err != nil {
 			errch <- err
@@ -80,7 +201,62 @@ func (s *BoreServer) Run() error {
 		}
 	}()
 
-	return <-errch
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s.httpServer.logger.Infof("received %s, shutting down", <-sig)
+		errch <- nil
+	}()
+
+	err := <-errch
+	s.metricsHub.Close()
+	return err
+}
+
+// tunnelID returns ID of the tunnel requests for host are routed to.
+// Custom domains are looked up first, other hosts are expected to be
+// <id>.<domain>.
+func (s *BoreServer) tunnelID(host string) string {
+	if id, ok := s.sshServer.domainTunnel(host); ok {
+		return id
+	}
+	return strings.Split(host, ".")[0]
+}
+
+// servesHost reports whether host is an attached custom domain or
+// <id>.<domain> of an open tunnel.
+func (s *BoreServer) servesHost(host string) bool {
+	id, ok := s.sshServer.domainTunnel(host)
+	if !ok {
+		id, ok = strings.CutSuffix(host, "."+s.opts.Domain)
+		if !ok || id == "" || strings.Contains(id, ".") {
+			return false
+		}
+	}
+
+	s.sshServer.mu.Lock()
+	defer s.sshServer.mu.Unlock()
+	_, ok = s.sshServer.tunnels[id]
+	return ok
+}
+
+// allowCertificate reports whether certificate may be requested for
+// host, which is the case for subdomains of open or held tunnels and
+// for attached custom domains.
+func (s *BoreServer) allowCertificate(host string) bool {
+	if _, ok := s.sshServer.domainTunnel(host); ok {
+		return true
+	}
+
+	id, ok := strings.CutSuffix(host, "."+s.opts.Domain)
+	if !ok || id == "" || strings.Contains(id, ".") {
+		return false
+	}
+
+	s.sshServer.mu.Lock()
+	defer s.sshServer.mu.Unlock()
+	_, open := s.sshServer.tunnels[id]
+	return open || s.sshServer.held(id)
 }
 
 func (s *BoreServer) getHandler(handler http.Handler) http.Handler {
@@ -98,7 +274,7 @@ func (s *BoreServer) getHandler(handler http.Handler) http.Handler {
 
 		var log string
 		if host != s.opts.Domain {
-			userID := strings.Split(host, ".")[0]
+			userID := s.tunnelID(host)
 			log = fmt.Sprintf(
 				"[%s] %s %s (code=%d dt=%s written=%s remote=%s)",
 				userID,
@@ -112,12 +288,13 @@ func (s *BoreServer) getHandler(handler http.Handler) http.Handler {
 			s.httpServer.logger.Debug(log)
 
 			s.sshServer.mu.Lock()
-			client, ok := s.sshServer.clients[userID]
+			tunnel, ok := s.sshServer.tunnels[userID]
 			s.sshServer.mu.Unlock()
 			if ok {
-				client.write(fmt.Sprintf("%s\n", log))
-				s.metricsHub.RecordTraffic(userID, uint64(r.ContentLength), uint64(m.Written))
+				tunnel.client.write(fmt.Sprintf("%s\n", log))
+				s.metricsHub.RecordTraffic(userID, uint64(max(r.ContentLength, 0)), uint64(m.Written))
 			}
+			s.metricsHub.RecordResponse(m.Code, m.Duration, ok)
 		} else {
 			log = fmt.Sprintf(
 				"%s %s (code=%d dt=%s written=%s remote=%s)",
@@ -129,6 +306,7 @@ func (s *BoreServer) getHandler(handler http.Handler) http.Handler {
 				remote,
 			)
 			s.httpServer.logger.Debug(log)
+			s.metricsHub.RecordResponse(m.Code, m.Duration, false)
 		}
 	})
 }
@@ -140,26 +318,74 @@ func (s *BoreServer) handleHTTP() http.Handler {
 			host = r.Host
 		}
 
+		remote := s.remoteAddr(r)
+		if !s.sshServer.ipFilter.allows(remote) || s.sshServer.bans.ip(remote) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		// The certificate is valid for all subdomains, so make sure the
+		// request is not routed to a different tunnel than the client
+		// negotiated TLS for.
+		if r.TLS != nil && r.TLS.ServerName != "" && !strings.EqualFold(r.TLS.ServerName, host) {
+			http.Error(w, "misdirected request", http.StatusMisdirectedRequest)
+			return
+		}
+
 		if host != s.opts.Domain {
-			splitted := strings.Split(host, ".")
-			userID := splitted[0]
+			userID := s.tunnelID(host)
 
 			s.sshServer.mu.Lock()
-			client, ok := s.sshServer.clients[userID]
+			tunnel, ok := s.sshServer.tunnels[userID]
 			s.sshServer.mu.Unlock()
 
-			if ok {
+			if ok && tunnel.udp == nil {
+				if !tunnel.ipFilter.allows(remote) {
+					http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+					return
+				}
+
+				if tunnel.oidc != nil {
+					if r.URL.Path == oidcSessionPath {
+						s.oidc.session(w, r, host)
+						return
+					}
+					sess, ok := s.oidc.authorize(w, r, host, tunnel.oidc)
+					if !ok {
+						return
+					}
+					removeCookie(r, oidcCookie)
+					r.Header.Set("X-Forwarded-Email", sess.Email)
+				}
+
+				if tunnel.auth != nil {
+					if !tunnel.auth.check(r) {
+						tunnel.auth.challenge(w)
+						return
+					}
+					r.Header.Del("Authorization")
+				}
+
 				w.Header().Set("X-Proxy", "bore")
+				if r.TLS != nil {
+					r.Header.Set("X-Forwarded-Proto", "https")
+				}
 
+				// Requests are proxied over channels opened on the SSH
+				// connection, the URL host is only used as the target name.
 				if strings.ToLower(r.Header.Get("Upgrade")) == "websocket" {
-					url := &url.URL{Scheme: "ws", Host: fmt.Sprintf("%s:%d", client.addr, client.port)}
+					url := &url.URL{Scheme: "ws", Host: tunnel.bind}
 					proxy := wsutil.NewSingleHostReverseProxy(url)
+					proxy.Dial = func(network, addr string) (net.Conn, error) {
+						return s.sshServer.dialTunnel(tunnel, r.RemoteAddr)
+					}
 					proxy.ServeHTTP(w, r)
 					return
 				}
 
-				url := &url.URL{Scheme: "http", Host: fmt.Sprintf("%s:%d", client.addr, client.port)}
+				url := &url.URL{Scheme: "http", Host: tunnel.bind}
 				proxy := httputil.NewSingleHostReverseProxy(url)
+				proxy.Transport = tunnel.transport
 				proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
 					if strings.Contains(err.Error(), "connection refused") || strings.Contains(err.Error(), "EOF") {
 						s.httpServer.logger.Debugf("[%s] tunnel closed during request: %v", userID, err)
@@ -168,6 +394,10 @@ func (s *BoreServer) handleHTTP() http.Handler {
 					}
 					w.WriteHeader(http.StatusBadGateway)
 				}
+				if captures := s.captures.active(tunnel.id); len(captures) > 0 {
+					serveCaptured(captures, proxy, w, r)
+					return
+				}
 				proxy.ServeHTTP(w, r)
 				return
 			}
@@ -177,11 +407,21 @@ func (s *BoreServer) handleHTTP() http.Handler {
 			return
 		}
 
+		if r.URL.Path == oidcCallbackPath && s.oidc != nil {
+			s.oidc.callback(w, r, s.servesHost)
+			return
+		}
+
 		if r.URL.Path == "/api/ws/dashboard" {
 			s.metricsHub.HandleWebSocket(w, r)
 			return
 		}
 
+		if r.URL.Path == "/api/metrics/history" {
+			s.metricsHub.HandleHistory(w, r)
+			return
+		}
+
 		s.UI.ServeHTTP(w, r)
 	})
 }
@@ -4,10 +4,14 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/netip"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/jkuri/bore/internal/version"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 )
@@ -25,23 +29,80 @@ type SSHServer struct {
 	config     *ssh.ServerConfig
 	running    chan error
 	isRunning  bool
-	clients    map[string]*client
+	tunnels    map[string]*tunnel
+	resumable  map[string]*resumeEntry // keyed by resume token
+	domains    map[string]string       // custom domain -> tunnel ID
+	ipFilter   *ipFilter               // applies to all tunnels
+	bans       *bans                   // owners and addresses banned at runtime
+	resolver   *net.Resolver
 	addr       string
 	domain     string
 	logger     *zap.SugaredLogger
 	metricsHub *MetricsHub
+
+	authorizedKeys *authorizedKeys
+	userCAKeys     *authorizedKeys
 }
 
 type client struct {
-	mu        sync.Mutex
+	mu          sync.Mutex
+	id          string
+	fingerprint string   // SHA256 fingerprint of the authenticated key, if any
+	token       string   // name of the authenticated API token, if any
+	cert        string   // key ID of the authenticated user certificate, if any
+	allowedIDs  []string // ID patterns the credential is restricted to, nil if unrestricted
+	tcpConn     net.Conn
+	sshConn     *ssh.ServerConn
+	ch          ssh.Channel
+	tunnels     map[string]*tunnel // keyed by bind address
+	nextID      string             // ID requested with set-id for the next tunnel
+	nextAuth    *tunnelAuth        // protection requested with set-auth for the next tunnel
+	nextOIDC    *tunnelOIDC        // login requested with set-oidc for the next tunnel
+	nextFilter  *ipFilter          // filter requested with set-ip-filter for the next tunnel
+}
+
+// tunnel is a single tcpip-forward listener or udp-forward port opened
+// by a client. One client can have multiple tunnels over the same SSH
+// connection.
+type tunnel struct {
 	id        string
-	tcpConn   net.Conn
-	sshConn   *ssh.ServerConn
-	ch        ssh.Channel
-	listeners map[string]net.Listener
+	client    *client
+	bind      string
 	addr      string
 	port      uint32
-	channels  map[ssh.Channel]bool
+	listener  net.Listener         // nil for UDP tunnels
+	udp       *udpRelay            // relays datagrams, set for UDP tunnels only
+	transport *http.Transport      // proxies HTTP requests over the SSH connection
+	channels  map[ssh.Channel]bool // guarded by client.mu
+	auth      *tunnelAuth          // HTTP auth required to access the tunnel, if any
+	oidc      *tunnelOIDC          // OIDC login required to access the tunnel, if any
+	ipFilter  *ipFilter            // addresses allowed to reach the tunnel, if restricted
+
+	resumeToken string   // guarded by client.mu
+	domains     []string // custom domains, guarded by SSHServer.mu
+}
+
+// allows reports whether addr may reach the tunnel according to the
+// server-wide and the tunnel's own address lists.
+func (s *SSHServer) allows(t *tunnel, addr netip.Addr) bool {
+	return s.ipFilter.allows(addr) && !s.bans.ip(addr) && t.ipFilter.allows(addr)
+}
+
+// protected reports whether visitors have to authenticate, in which
+// case the tunnel is only reachable over HTTP.
+func (t *tunnel) protected() bool {
+	return t.auth != nil || t.oidc != nil
+}
+
+// owner returns a label identifying who opened the tunnel.
+func (c *client) owner() string {
+	if c.token != "" {
+		return "token:" + c.token
+	}
+	if c.cert != "" {
+		return "cert:" + c.cert
+	}
+	return c.fingerprint
 }
 
 func (c *client) write(data string) {
@@ -52,16 +113,40 @@ func (c *client) write(data string) {
 
 // NewSSHServer returns new instance of SSHServer.
 func NewSSHServer(opts *Options, logger *zap.SugaredLogger) *SSHServer {
-	return &SSHServer{
-		opts: opts,
-		config: &ssh.ServerConfig{
-			NoClientAuth: true,
-		},
+	s := &SSHServer{
+		opts:      opts,
+		config:    &ssh.ServerConfig{},
 		running:   make(chan error, 1),
-		clients:   make(map[string]*client),
+		tunnels:   make(map[string]*tunnel),
+		resumable: make(map[string]*resumeEntry),
+		domains:   make(map[string]string),
+		resolver:  newResolver(opts.Resolver),
+		bans:      newBans(),
 		logger:    logger,
 		isRunning: true,
 	}
+
+	// Lists are validated by NewOptions.
+	s.ipFilter, _ = newIPFilter(opts.AllowIPs, opts.DenyIPs)
+
+	if opts.AuthorizedKeys != "" {
+		s.authorizedKeys = newAuthorizedKeys(opts.AuthorizedKeys)
+	}
+	if opts.TrustedUserCAKeys != "" {
+		s.userCAKeys = newAuthorizedKeys(opts.TrustedUserCAKeys)
+	}
+	if s.authorizedKeys != nil || s.userCAKeys != nil {
+		s.config.PublicKeyCallback = s.publicKeyCallback
+	}
+	if len(opts.Tokens) > 0 {
+		s.config.PasswordCallback = s.passwordCallback
+		s.config.KeyboardInteractiveCallback = s.keyboardInteractiveCallback
+	}
+	if s.config.PublicKeyCallback == nil && s.config.PasswordCallback == nil {
+		s.config.NoClientAuth = true
+	}
+
+	return s
 }
 
 // Run starts the SSH server.
@@ -75,6 +160,18 @@ func (s *SSHServer) Run() error {
 		return err
 	}
 	s.config.AddHostKey(private)
+
+	if s.authorizedKeys != nil {
+		if err := s.authorizedKeys.load(); err != nil {
+			return err
+		}
+	}
+	if s.userCAKeys != nil {
+		if err := s.userCAKeys.load(); err != nil {
+			return err
+		}
+	}
+
 	s.addr = s.opts.SSHAddr
 	s.domain = s.opts.Domain
 
@@ -120,49 +217,68 @@ func (s *SSHServer) listen() error {
 			continue
 		}
 
+		if s.bans.ip(connAddr(tcpConn)) {
+			s.logger.Infof("refused SSH connection from banned address %s", tcpConn.RemoteAddr())
+			tcpConn.Close()
+			continue
+		}
+
 		sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, s.config)
 		if err != nil {
 			s.logger.Errorf("failed to handshake: %v", err)
+			s.metricsHub.RecordHandshakeFailure()
 			continue
 		}
 
 	genid:
 		id := randID()
-		if _, ok := s.clients[id]; ok {
+		s.mu.Lock()
+		_, taken := s.tunnels[id]
+		s.mu.Unlock()
+		if taken || s.reserved(id) {
 			goto genid
 		}
 
 		c := &client{
-			id:        id,
-			tcpConn:   tcpConn,
-			sshConn:   sshConn,
-			listeners: make(map[string]net.Listener),
-			channels:  make(map[ssh.Channel]bool),
-			addr:      "",
-			port:      0,
+			id:      id,
+			tcpConn: tcpConn,
+			sshConn: sshConn,
+			tunnels: make(map[string]*tunnel),
+		}
+		if sshConn.Permissions != nil {
+			c.fingerprint = sshConn.Permissions.Extensions[permFingerprint]
+			c.token = sshConn.Permissions.Extensions[permToken]
+			c.cert = sshConn.Permissions.Extensions[permCert]
+			if ids, ok := sshConn.Permissions.Extensions[permIDs]; ok {
+				c.allowedIDs = strings.Split(ids, ",")
+			}
+		}
+		if s.bans.owner(c.owner()) {
+			s.logger.Infof("refused SSH connection from %s, %s is banned", sshConn.RemoteAddr(), c.owner())
+			sshConn.Close()
+			continue
+		}
+		if owner := c.owner(); owner != "" {
+			s.logger.Infof("new SSH connection from %s (%s) as %s", sshConn.RemoteAddr().String(), sshConn.ClientVersion(), owner)
+		} else {
+			s.logger.Infof("new SSH connection from %s (%s)", sshConn.RemoteAddr().String(), sshConn.ClientVersion())
 		}
-		s.logger.Infof("new SSH connection from %s (%s)", sshConn.RemoteAddr().String(), sshConn.ClientVersion())
 
 		go func(c *client) {
 			err := c.sshConn.Wait()
 			s.logger.Infof("[%s] SSH connection closed: %v", c.id, err)
 
 			c.mu.Lock()
-			for ch := range c.channels {
-				ch.Close()
+			tunnels := make([]*tunnel, 0, len(c.tunnels))
+			for _, t := range c.tunnels {
+				tunnels = append(tunnels, t)
 			}
 			c.mu.Unlock()
 
-			c.mu.Lock()
-			for bind, listener := range c.listeners {
-				s.logger.Debugf("[%s] closing listener bound to %s", c.id, bind)
-				listener.Close()
+			for _, t := range tunnels {
+				s.holdTunnel(t)
+				s.closeTunnel(t)
 			}
-			c.mu.Unlock()
-
-			s.mu.Lock()
-			delete(s.clients, c.id)
-			s.mu.Unlock()
 		}(c)
 
 		go s.handleRequests(c, reqs)
@@ -191,18 +307,203 @@ func (s *SSHServer) handleRequests(client *client, reqs <-chan *ssh.Request) {
 				s.logger.Errorf("[%s] Unable to unmarshal payload: %v", client.id, err)
 			}
 			if payload.ID != "" {
-				if _, ok := s.clients[payload.ID]; !ok {
-					s.mu.Lock()
-					delete(s.clients, client.id)
-					client.id = payload.ID
-					s.clients[client.id] = client
-					s.mu.Unlock()
+				if err := s.canClaim(client, payload.ID); err != nil {
+					s.logger.Infof("[%s] refused id %q for %q: %v", client.id, payload.ID, client.owner(), err)
+					req.Reply(false, ssh.Marshal(&requestErrorPayload{err.Error()}))
+					continue
+				}
+
+				s.mu.Lock()
+				_, taken := s.tunnels[payload.ID]
+				taken = taken || s.claimHeld(payload.ID, client.owner())
+				if !taken {
+					client.nextID = payload.ID
 				}
+				s.mu.Unlock()
+				if taken {
+					s.logger.Infof("[%s] refused id %q, it is in use", client.id, payload.ID)
+					req.Reply(false, ssh.Marshal(&requestErrorPayload{fmt.Sprintf("id %q is in use", payload.ID)}))
+					continue
+				}
+			}
+			req.Reply(true, []byte{})
+			continue
+		}
+
+		if req.Type == "set-auth" {
+			var payload setAuthPayload
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				s.logger.Errorf("[%s] unable to unmarshal payload: %v", client.id, err)
+				req.Reply(false, []byte{})
+				continue
+			}
+			auth, err := newTunnelAuth(payload)
+			if err != nil {
+				req.Reply(false, ssh.Marshal(&requestErrorPayload{err.Error()}))
+				continue
+			}
+			s.mu.Lock()
+			client.nextAuth = auth
+			s.mu.Unlock()
+			req.Reply(true, []byte{})
+			continue
+		}
+
+		if req.Type == "set-oidc" {
+			var payload setOIDCPayload
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				s.logger.Errorf("[%s] unable to unmarshal payload: %v", client.id, err)
+				req.Reply(false, []byte{})
+				continue
+			}
+			if s.opts.OIDC.Issuer == "" {
+				req.Reply(false, ssh.Marshal(&requestErrorPayload{"OIDC login is not configured on this server"}))
+				continue
+			}
+			s.mu.Lock()
+			client.nextOIDC = newTunnelOIDC(payload)
+			s.mu.Unlock()
+			req.Reply(true, []byte{})
+			continue
+		}
+
+		if req.Type == "set-ip-filter" {
+			var payload setIPFilterPayload
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				s.logger.Errorf("[%s] unable to unmarshal payload: %v", client.id, err)
+				req.Reply(false, []byte{})
+				continue
+			}
+			filter, err := newIPFilter(strings.Split(payload.Allow, ","), strings.Split(payload.Deny, ","))
+			if err != nil {
+				req.Reply(false, ssh.Marshal(&requestErrorPayload{err.Error()}))
+				continue
+			}
+			s.mu.Lock()
+			client.nextFilter = filter
+			s.mu.Unlock()
+			req.Reply(true, []byte{})
+			continue
+		}
+
+		if req.Type == "resume" {
+			var payload resumeRequestPayload
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				s.logger.Errorf("[%s] unable to unmarshal payload: %v", client.id, err)
+				req.Reply(false, []byte{})
+				continue
+			}
+			entry, err := s.resume(client, payload.Token)
+			if err != nil {
+				s.logger.Debugf("[%s] unable to resume tunnel: %v", client.id, err)
+				req.Reply(false, ssh.Marshal(&requestErrorPayload{err.Error()}))
+				continue
+			}
+			s.logger.Infof("[%s] resuming tunnel on port %d", entry.id, entry.port)
+			req.Reply(true, ssh.Marshal(&resumeReplyPayload{entry.id, entry.port}))
+			continue
+		}
+
+		if req.Type == "tunnel-info" {
+			var payload tcpIPForwardPayload
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				s.logger.Errorf("[%s] unable to unmarshal payload: %v", client.id, err)
+				req.Reply(false, []byte{})
+				continue
+			}
+			client.mu.Lock()
+			t, ok := client.tunnels[fmt.Sprintf("%s:%d", payload.Addr, payload.Port)]
+			client.mu.Unlock()
+			if !ok {
+				req.Reply(false, ssh.Marshal(&requestErrorPayload{"no such tunnel"}))
+				continue
+			}
+			data := clientResponse{id: t.id, domain: s.domain, port: t.port, public: s.opts.PublicPorts, udp: t.udp != nil}
+			req.Reply(true, ssh.Marshal(&tunnelInfoPayload{
+				ID:       data.id,
+				HTTPURL:  data.httpURL(),
+				HTTPSURL: data.httpsURL(),
+				TCPAddr:  data.tcpAddr(),
+				Version:  version.Version,
+			}))
+			continue
+		}
+
+		if req.Type == "add-domain" {
+			var payload addDomainPayload
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				s.logger.Errorf("[%s] unable to unmarshal payload: %v", client.id, err)
+				req.Reply(false, []byte{})
+				continue
+			}
+			client.mu.Lock()
+			t, ok := client.tunnels[fmt.Sprintf("%s:%d", payload.Addr, payload.Port)]
+			client.mu.Unlock()
+			if !ok {
+				req.Reply(false, ssh.Marshal(&requestErrorPayload{"no such tunnel"}))
+				continue
+			}
+			if t.udp != nil {
+				req.Reply(false, ssh.Marshal(&requestErrorPayload{"custom domains route HTTP and can't be attached to UDP tunnels"}))
+				continue
+			}
+			if err := s.addDomain(t, payload.Domain); err != nil {
+				s.logger.Infof("[%s] refused domain %q for %q: %v", t.id, payload.Domain, client.owner(), err)
+				req.Reply(false, ssh.Marshal(&requestErrorPayload{err.Error()}))
+				continue
 			}
+			s.logger.Infof("[%s] custom domain %s attached", t.id, payload.Domain)
 			req.Reply(true, []byte{})
 			continue
 		}
 
+		if req.Type == "resume-token" {
+			var payload tcpIPForwardPayload
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				s.logger.Errorf("[%s] unable to unmarshal payload: %v", client.id, err)
+				req.Reply(false, []byte{})
+				continue
+			}
+			client.mu.Lock()
+			t, ok := client.tunnels[fmt.Sprintf("%s:%d", payload.Addr, payload.Port)]
+			client.mu.Unlock()
+			if !ok {
+				req.Reply(false, ssh.Marshal(&requestErrorPayload{"no such tunnel"}))
+				continue
+			}
+			token, err := s.issueResumeToken(t)
+			if err != nil {
+				req.Reply(false, ssh.Marshal(&requestErrorPayload{err.Error()}))
+				continue
+			}
+			req.Reply(true, ssh.Marshal(&resumeTokenReplyPayload{token}))
+			continue
+		}
+
+		if req.Type == "udp-forward" {
+			conn, bindInfo, err := s.handleUDPForward(client, req)
+			if err != nil {
+				s.logger.Infof("[%s] refused UDP tunnel: %v", client.id, err)
+				continue
+			}
+
+			t, err := s.addTunnel(client, bindInfo, nil, newUDPRelay(conn))
+			if err != nil {
+				s.logger.Errorf("[%s] error, disconnecting: %v", client.id, err)
+				conn.Close()
+				client.tcpConn.Close()
+				continue
+			}
+
+			if owner := client.owner(); owner != "" {
+				s.logger.Infof("[%s] UDP tunnel bound to %s owned by %s", t.id, bindInfo.Bound, owner)
+			}
+
+			go s.relayUDP(t)
+			s.renderTunnel(client, t)
+			continue
+		}
+
 		if req.Type == "tcpip-forward" {
 			listener, bindInfo, err := s.handleForward(client, req)
 			if err != nil {
@@ -211,57 +512,186 @@ func (s *SSHServer) handleRequests(client *client, reqs <-chan *ssh.Request) {
 				continue
 			}
 
-			client.addr = bindInfo.Addr
-			client.port = bindInfo.Port
+			t, err := s.addTunnel(client, bindInfo, listener, nil)
+			if err != nil {
+				s.logger.Errorf("[%s] error, disconnecting: %v", client.id, err)
+				listener.Close()
+				client.tcpConn.Close()
+				continue
+			}
+
+			if owner := client.owner(); owner != "" {
+				s.logger.Infof("[%s] tunnel bound to %s owned by %s", t.id, bindInfo.Bound, owner)
+			}
 
+			go s.handleListener(t, bindInfo, listener)
+			s.renderTunnel(client, t)
+		} else if req.Type == "cancel-tcpip-forward" {
+			var payload tcpIPForwardPayload
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				s.logger.Errorf("[%s] unable to unmarshal payload: %v", client.id, err)
+				req.Reply(false, []byte{})
+				continue
+			}
+
+			bind := fmt.Sprintf("%s:%d", payload.Addr, payload.Port)
 			client.mu.Lock()
-			client.listeners[bindInfo.Bound] = listener
+			t, ok := client.tunnels[bind]
 			client.mu.Unlock()
+			if !ok {
+				req.Reply(false, []byte{})
+				continue
+			}
 
-			s.mu.Lock()
-			s.clients[client.id] = client
-			s.mu.Unlock()
+			s.closeTunnel(t)
+			req.Reply(true, []byte{})
+		} else {
+			req.Reply(false, []byte{})
+		}
+	}
+}
 
-			go s.handleListener(client, bindInfo, listener)
+// renderTunnel writes addresses of the new tunnel to the client's
+// session, preceded by the welcome message for the first tunnel.
+func (s *SSHServer) renderTunnel(client *client, t *tunnel) {
+	if client.ch == nil {
+		return
+	}
+	data := clientResponse{
+		id:     t.id,
+		domain: s.domain,
+		port:   t.port,
+		public: s.opts.PublicPorts,
+		udp:    t.udp != nil,
+	}
 
-			if client.ch != nil {
-				data := clientResponse{
-					id:     client.id,
-					domain: s.domain,
-					port:   client.port,
-				}
+	client.mu.Lock()
+	first := len(client.tunnels) == 1
+	client.mu.Unlock()
+	if first {
+		renderMessage(data, client.ch)
+	}
+	renderTable(data, client.ch)
+}
+
+// addTunnel registers a new tunnel for the listener or UDP relay under
+// the ID the client claimed with set-id, or under a random ID if none
+// was claimed. It fails if another client took the claimed ID since.
+func (s *SSHServer) addTunnel(client *client, bindInfo *bindInfo, listener net.Listener, udp *udpRelay) (*tunnel, error) {
+	t := &tunnel{
+		client:   client,
+		bind:     bindInfo.Bound,
+		addr:     bindInfo.Addr,
+		port:     bindInfo.Port,
+		listener: listener,
+		udp:      udp,
+		channels: make(map[ssh.Channel]bool),
+	}
 
-				renderMessage(data, client.ch)
-				renderTable(data, client.ch)
+	s.mu.Lock()
+	id := client.nextID
+	client.nextID = ""
+	t.auth = client.nextAuth
+	t.oidc = client.nextOIDC
+	t.ipFilter = client.nextFilter
+	client.nextAuth = nil
+	client.nextOIDC = nil
+	client.nextFilter = nil
+	if _, taken := s.tunnels[id]; taken {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("id %q is in use", id)
+	}
+	if id == "" {
+		for {
+			id = randID()
+			if _, taken := s.tunnels[id]; !taken && !s.held(id) && !s.reserved(id) {
+				break
 			}
-		} else {
-			req.Reply(false, []byte{})
 		}
 	}
+	t.id = id
+	t.transport = s.newTunnelTransport(t)
+	s.tunnels[id] = t
+	s.mu.Unlock()
+
+	client.mu.Lock()
+	if len(client.tunnels) == 0 {
+		client.id = id
+	}
+	client.tunnels[t.bind] = t
+	client.mu.Unlock()
+
+	return t, nil
 }
 
-func (s *SSHServer) handleListener(client *client, bindInfo *bindInfo, listener net.Listener) {
+// closeTunnel closes the tunnel listener with all its open channels
+// and removes it from the server.
+func (s *SSHServer) closeTunnel(t *tunnel) {
+	t.client.mu.Lock()
+	for ch := range t.channels {
+		ch.Close()
+	}
+	delete(t.client.tunnels, t.bind)
+	token := t.resumeToken
+	t.client.mu.Unlock()
+
+	s.logger.Debugf("[%s] closing listener bound to %s", t.id, t.bind)
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	if t.udp != nil {
+		t.udp.close()
+	}
+	t.transport.CloseIdleConnections()
+
+	s.mu.Lock()
+	s.removeDomains(t)
+	if s.tunnels[t.id] == t {
+		delete(s.tunnels, t.id)
+	}
+	if entry, ok := s.resumable[token]; ok && entry.tunnel == t {
+		// Closed while open, not held for reconnect.
+		delete(s.resumable, token)
+	}
+	s.mu.Unlock()
+}
+
+func (s *SSHServer) handleListener(t *tunnel, bindInfo *bindInfo, listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			neterr := err.(net.Error)
 			if neterr.Timeout() {
-				s.logger.Errorf("[%s] accept failed with timeout: %v", client.id, err)
+				s.logger.Errorf("[%s] accept failed with timeout: %v", t.id, err)
 				continue
 			}
 			if neterr.Temporary() {
-				s.logger.Errorf("[%s] accept failed with temporary: %v", client.id, err)
+				s.logger.Errorf("[%s] accept failed with temporary: %v", t.id, err)
 				continue
 			}
 
 			break
 		}
 
-		go s.handleForwardTCPIP(client, bindInfo, conn)
+		if !s.allows(t, connAddr(conn)) {
+			s.logger.Debugf("[%s] TCP connection from %s refused by IP filter", t.id, conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		// Raw TCP can't be authenticated, protected tunnels are only
+		// reachable over HTTP.
+		if t.protected() {
+			s.logger.Debugf("[%s] TCP connection from %s refused, tunnel requires HTTP auth", t.id, conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		go s.handleForwardTCPIP(t, bindInfo, conn)
 	}
 }
 
-func (s *SSHServer) handleForwardTCPIP(client *client, bindInfo *bindInfo, conn net.Conn) {
+func (s *SSHServer) handleForwardTCPIP(t *tunnel, bindInfo *bindInfo, conn net.Conn) {
 	remoteAddr := conn.RemoteAddr().(*net.TCPAddr)
 	raddr := remoteAddr.IP.String()
 	rport := uint32(remoteAddr.Port)
@@ -270,27 +700,27 @@ func (s *SSHServer) handleForwardTCPIP(client *client, bindInfo *bindInfo, conn
 	mpayload := ssh.Marshal(&payload)
 
 	// open channel with client
-	c, requests, err := client.sshConn.OpenChannel("forwarded-tcpip", mpayload)
+	c, requests, err := t.client.sshConn.OpenChannel("forwarded-tcpip", mpayload)
 	if err != nil {
-		s.logger.Errorf("[%s] unable to get channel: %v. Hanging up requesting party!", client.id, err)
+		s.logger.Errorf("[%s] unable to get channel: %v. Hanging up requesting party!", t.id, err)
 		conn.Close()
 		return
 	}
-	s.logger.Debugf("[%s] channel opened for client %s:%d <-> %s", client.id, bindInfo.Addr, bindInfo.Port, remoteAddr.String())
+	s.logger.Debugf("[%s] channel opened for client %s:%d <-> %s", t.id, bindInfo.Addr, bindInfo.Port, remoteAddr.String())
 
 	go ssh.DiscardRequests(requests)
 
-	client.mu.Lock()
-	client.channels[c] = true
-	client.mu.Unlock()
+	t.client.mu.Lock()
+	t.channels[c] = true
+	t.client.mu.Unlock()
 
 	go func() {
 		defer func() {
-			client.mu.Lock()
-			delete(client.channels, c)
-			client.mu.Unlock()
+			t.client.mu.Lock()
+			delete(t.channels, c)
+			t.client.mu.Unlock()
 		}()
-		s.handleForwardTCPIPTransfer(client.id, c, conn)
+		s.handleForwardTCPIPTransfer(t.id, c, conn)
 	}()
 }
 
@@ -304,13 +734,27 @@ func (s *SSHServer) handleForward(client *client, req *ssh.Request) (net.Listene
 
 	s.logger.Debugf("[%s] request: %s %v %v", client.id, req.Type, req.WantReply, payload)
 
+	if err := s.checkClaimed(client); err != nil {
+		req.Reply(false, ssh.Marshal(&requestErrorPayload{err.Error()}))
+		return nil, nil, err
+	}
+
 listen:
 	bind := fmt.Sprintf("%s:%d", payload.Addr, payload.Port)
 	if payload.Port == 0 {
 		bind = fmt.Sprintf("%s:%d", payload.Addr, randomPort(minPort, maxPort))
 	}
 
-	ln, err := net.Listen("tcp", bind)
+	// Without public ports the listener only serves to allocate the port
+	// the client refers to the tunnel with, HTTP and TLS passthrough
+	// traffic goes over the SSH connection.
+	listenAddr := bind
+	if !s.opts.PublicPorts {
+		_, port, _ := net.SplitHostPort(bind)
+		listenAddr = net.JoinHostPort("127.0.0.1", port)
+	}
+
+	ln, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		if payload.Port == 0 {
 			s.logger.Errorf("[%s] listen failed for: %s %v, retrying on another port", client.id, bind, err)
@@ -323,6 +767,32 @@ listen:
 	port := ln.Addr().(*net.TCPAddr).Port
 	bind = fmt.Sprintf("%s:%d", payload.Addr, port)
 
+	// Tunnels of a client are keyed by bind address, which must not
+	// clash with a UDP tunnel on the same port.
+	client.mu.Lock()
+	_, taken := client.tunnels[bind]
+	client.mu.Unlock()
+	if taken {
+		ln.Close()
+		if payload.Port == 0 {
+			goto listen
+		}
+		s.logger.Errorf("[%s] listen failed for: %s, port is used by another tunnel", client.id, bind)
+		req.Reply(false, []byte{})
+		return nil, nil, fmt.Errorf("unable to listen")
+	}
+
+	// Ports of dropped tunnels are kept for their clients to resume.
+	if !s.portAvailable(client, uint32(port), false, payload.Port == 0) {
+		ln.Close()
+		if payload.Port == 0 {
+			goto listen
+		}
+		s.logger.Errorf("[%s] listen failed for: %s, port is held for a reconnecting client", client.id, bind)
+		req.Reply(false, ssh.Marshal(&requestErrorPayload{fmt.Sprintf("port %d is held for a reconnecting client", port)}))
+		return nil, nil, fmt.Errorf("unable to listen")
+	}
+
 	s.logger.Debugf("[%s] listening on %s", client.id, bind)
 	reply := tcpIPForwardPayloadReply{uint32(port)}
 	req.Reply(true, ssh.Marshal(&reply))
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// certificate is a TLS certificate backed by PEM encoded certificate
+// and key files. The files are re-read whenever their modification
+// time changes, so renewed certificates are picked up without
+// restarting the server.
+type certificate struct {
+	mu          sync.Mutex
+	certFile    string
+	keyFile     string
+	certModTime time.Time
+	keyModTime  time.Time
+	cert        *tls.Certificate
+	logger      *zap.SugaredLogger
+}
+
+func newCertificate(certFile, keyFile string, logger *zap.SugaredLogger) *certificate {
+	return &certificate{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+	}
+}
+
+// load reads the certificate and key files if either was modified
+// since the last successful read.
+func (c *certificate) load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil && certInfo.ModTime().Equal(c.certModTime) && keyInfo.ModTime().Equal(c.keyModTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate %s: %v", c.certFile, err)
+	}
+
+	c.cert = &cert
+	c.certModTime = certInfo.ModTime()
+	c.keyModTime = keyInfo.ModTime()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. If reloading
+// fails, e.g. while the files are being replaced, the previously loaded
+// certificate is used.
+func (c *certificate) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if err := c.load(); err != nil {
+		c.logger.Errorf("%v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert == nil {
+		return nil, fmt.Errorf("no TLS certificate loaded")
+	}
+	return c.cert, nil
+}
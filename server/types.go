@@ -1,5 +1,7 @@
 package server
 
+import "fmt"
+
 // Structure contains data of what address/port
 // we should bind forwarded-tcpip connections
 type bindInfo struct {
@@ -24,12 +26,92 @@ type tcpIPForwardPayloadReply struct {
 	Port uint32
 }
 
+// udpForwardReplyPayload is the reply to udp-forward. Clients close
+// local sockets of senders after the same IdleTimeout the server
+// forgets them after.
+type udpForwardReplyPayload struct {
+	Port        uint32
+	IdleTimeout uint32 // milliseconds
+}
+
 type idRequestPayload struct {
 	ID string
 }
 
+type resumeRequestPayload struct {
+	Token string
+}
+
+type resumeReplyPayload struct {
+	ID   string
+	Port uint32
+}
+
+type resumeTokenReplyPayload struct {
+	Token string
+}
+
+type setAuthPayload struct {
+	Username string
+	Password string
+	Bearer   string
+}
+
+type setOIDCPayload struct {
+	Domains string // comma separated
+	Groups  string // comma separated
+}
+
+type setIPFilterPayload struct {
+	Allow string // comma separated
+	Deny  string // comma separated
+}
+
+type addDomainPayload struct {
+	Addr   string
+	Port   uint32
+	Domain string
+}
+
+type requestErrorPayload struct {
+	Message string
+}
+
 type clientResponse struct {
 	id     string
 	port   uint32
 	domain string
+	public bool // whether the port accepts TCP connections
+	udp    bool // whether the tunnel forwards UDP datagrams
+}
+
+func (r clientResponse) httpURL() string {
+	if r.udp {
+		return ""
+	}
+	return fmt.Sprintf("http://%s.%s", r.id, r.domain)
+}
+
+func (r clientResponse) httpsURL() string {
+	if r.udp {
+		return ""
+	}
+	return fmt.Sprintf("https://%s.%s", r.id, r.domain)
+}
+
+// tcpAddr returns address of the tunnel port, or empty string if the
+// port is not public. For UDP tunnels it is the UDP port address.
+func (r clientResponse) tcpAddr() string {
+	if !r.public {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", r.domain, r.port)
+}
+
+type tunnelInfoPayload struct {
+	ID       string
+	HTTPURL  string
+	HTTPSURL string
+	TCPAddr  string
+	Version  string
 }
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/jkuri/bore/pkg/udpframe"
+	"golang.org/x/crypto/ssh"
+)
+
+// maxUDPPeers limits peers remembered per UDP tunnel, datagrams from
+// new peers are dropped above it.
+const maxUDPPeers = 1024
+
+// udpRelay forwards datagrams between the UDP port of a tunnel and the
+// client. All peers share one forwarded-udp channel on which datagrams
+// are framed with the peer address. Datagrams from the client are only
+// sent to peers that recently sent datagrams to the port, so the server
+// can't be used to send to arbitrary addresses.
+type udpRelay struct {
+	conn *net.UDPConn
+	ch   ssh.Channel
+	wmu  sync.Mutex // serializes frames written to ch
+
+	mu    sync.Mutex
+	peers map[netip.AddrPort]time.Time // last datagram from or to the peer
+}
+
+func newUDPRelay(conn *net.UDPConn) *udpRelay {
+	return &udpRelay{conn: conn, peers: make(map[netip.AddrPort]time.Time)}
+}
+
+// touch records activity of the peer. Unknown peers are added if add is
+// set and the peer limit is not reached. It reports whether the peer is
+// known.
+func (r *udpRelay) touch(peer netip.AddrPort, add bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.peers[peer]; !ok && (!add || len(r.peers) >= maxUDPPeers) {
+		return false
+	}
+	r.peers[peer] = time.Now()
+	return true
+}
+
+// expire forgets peers idle for longer than timeout and returns how many.
+func (r *udpRelay) expire(timeout time.Duration) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for peer, last := range r.peers {
+		if time.Since(last) > timeout {
+			delete(r.peers, peer)
+			n++
+		}
+	}
+	return n
+}
+
+func (r *udpRelay) send(peer netip.AddrPort, data []byte) error {
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+	return udpframe.Write(r.ch, udpframe.Datagram{Addr: peer.Addr().String(), Port: uint32(peer.Port()), Data: data})
+}
+
+func (r *udpRelay) close() {
+	r.conn.Close()
+}
+
+// handleUDPForward binds the UDP port requested with udp-forward and
+// replies with the bound port and the peer idle timeout.
+func (s *SSHServer) handleUDPForward(client *client, req *ssh.Request) (*net.UDPConn, *bindInfo, error) {
+	var payload tcpIPForwardPayload
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		req.Reply(false, []byte{})
+		return nil, nil, fmt.Errorf("unable to parse payload")
+	}
+
+	s.logger.Debugf("[%s] request: %s %v %v", client.id, req.Type, req.WantReply, payload)
+
+	// Datagrams can only reach the tunnel on its port.
+	if !s.opts.PublicPorts {
+		err := fmt.Errorf("UDP tunnels require public ports, which this server disables")
+		req.Reply(false, ssh.Marshal(&requestErrorPayload{err.Error()}))
+		return nil, nil, err
+	}
+	if err := s.checkClaimed(client); err != nil {
+		req.Reply(false, ssh.Marshal(&requestErrorPayload{err.Error()}))
+		return nil, nil, err
+	}
+	s.mu.Lock()
+	protected := client.nextAuth != nil || client.nextOIDC != nil
+	client.nextAuth = nil
+	client.nextOIDC = nil
+	s.mu.Unlock()
+	if protected {
+		err := fmt.Errorf("UDP tunnels can't require HTTP auth or OIDC login")
+		req.Reply(false, ssh.Marshal(&requestErrorPayload{err.Error()}))
+		return nil, nil, err
+	}
+
+	for {
+		port := payload.Port
+		if port == 0 {
+			port = uint32(randomPort(minPort, maxPort))
+		}
+		bind := fmt.Sprintf("%s:%d", payload.Addr, port)
+
+		// Tunnels of a client are keyed by bind address, which must not
+		// clash with a TCP tunnel on the same port.
+		client.mu.Lock()
+		_, taken := client.tunnels[bind]
+		client.mu.Unlock()
+
+		var conn *net.UDPConn
+		addr, err := net.ResolveUDPAddr("udp", bind)
+		if err == nil && taken {
+			err = fmt.Errorf("port %d is used by another tunnel", port)
+		}
+		if err == nil && !s.portAvailable(client, port, true, payload.Port == 0) {
+			err = fmt.Errorf("port %d is held for a reconnecting client", port)
+		}
+		if err == nil {
+			conn, err = net.ListenUDP("udp", addr)
+		}
+		if err != nil {
+			if payload.Port == 0 {
+				s.logger.Errorf("[%s] UDP listen failed for: %s %v, retrying on another port", client.id, bind, err)
+				continue
+			}
+			s.logger.Errorf("[%s] UDP listen failed for: %s %v", client.id, bind, err)
+			req.Reply(false, ssh.Marshal(&requestErrorPayload{fmt.Sprintf("unable to listen on UDP port %d", port)}))
+			return nil, nil, err
+		}
+
+		s.logger.Debugf("[%s] listening on UDP %s", client.id, bind)
+		req.Reply(true, ssh.Marshal(&udpForwardReplyPayload{port, uint32(s.opts.UDPIdleTimeout.Milliseconds())}))
+		return conn, &bindInfo{bind, port, payload.Addr}, nil
+	}
+}
+
+// relayUDP opens the forwarded-udp channel to the client and relays
+// datagrams until the channel or the tunnel is closed.
+func (s *SSHServer) relayUDP(t *tunnel) {
+	r := t.udp
+	payload := forwardedTCPPayload{t.addr, t.port, "", 0}
+	ch, requests, err := t.client.sshConn.OpenChannel("forwarded-udp", ssh.Marshal(&payload))
+	if err != nil {
+		s.logger.Errorf("[%s] unable to open UDP channel: %v", t.id, err)
+		s.closeTunnel(t)
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	t.client.mu.Lock()
+	t.channels[ch] = true
+	t.client.mu.Unlock()
+	r.ch = ch
+
+	done := make(chan struct{})
+	go s.expireUDPPeers(t, done)
+	go s.udpToClient(t)
+	s.udpFromClient(t)
+	close(done)
+
+	// The client closed the channel, or the tunnel is being closed.
+	s.closeTunnel(t)
+}
+
+// udpToClient forwards datagrams received on the tunnel port to the
+// client.
+func (s *SSHServer) udpToClient(t *tunnel) {
+	r := t.udp
+	buf := make([]byte, 64*1024)
+	for {
+		n, peer, err := r.conn.ReadFromUDPAddrPort(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		peer = netip.AddrPortFrom(peer.Addr().Unmap(), peer.Port())
+
+		if !s.allows(t, peer.Addr()) {
+			s.logger.Debugf("[%s] UDP datagram from %s refused by IP filter", t.id, peer)
+			continue
+		}
+		if !r.touch(peer, true) {
+			s.logger.Debugf("[%s] UDP datagram from %s dropped, too many peers", t.id, peer)
+			continue
+		}
+		if err := r.send(peer, buf[:n]); err != nil {
+			return
+		}
+		if s.metricsHub != nil {
+			s.metricsHub.RecordTraffic(t.id, uint64(n), 0)
+		}
+	}
+}
+
+// udpFromClient sends datagrams read from the channel to the peers they
+// are addressed to.
+func (s *SSHServer) udpFromClient(t *tunnel) {
+	r := t.udp
+	br := bufio.NewReader(r.ch)
+	for {
+		d, err := udpframe.Read(br)
+		if err != nil {
+			if err != io.EOF {
+				s.logger.Debugf("[%s] UDP channel closed: %v", t.id, err)
+			}
+			return
+		}
+		addr, err := netip.ParseAddr(d.Addr)
+		if err != nil || d.Port > 0xffff {
+			continue
+		}
+		peer := netip.AddrPortFrom(addr, uint16(d.Port))
+		if !r.touch(peer, false) {
+			s.logger.Debugf("[%s] UDP datagram to unknown peer %s dropped", t.id, peer)
+			continue
+		}
+		n, err := r.conn.WriteToUDPAddrPort(d.Data, peer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err == nil && s.metricsHub != nil {
+			s.metricsHub.RecordTraffic(t.id, 0, uint64(n))
+		}
+	}
+}
+
+func (s *SSHServer) expireUDPPeers(t *tunnel, done <-chan struct{}) {
+	timeout := s.opts.UDPIdleTimeout
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if n := t.udp.expire(timeout); n > 0 {
+				s.logger.Debugf("[%s] %d idle UDP peers expired", t.id, n)
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -1,5 +1,6 @@
 import { Activity, ArrowDown, ArrowUp, Network } from "lucide-react";
 import { useEffect, useState } from "react";
+import HistoryChart from "./history-chart";
 import { Badge } from "./ui/badge";
 import {
   Card,
@@ -22,6 +23,7 @@ interface TunnelMetrics {
   domain: string;
   port: number;
   addr: string;
+  owner?: string;
   bytesIn: number;
   bytesOut: number;
   cumulativeBytesIn: number;
@@ -263,6 +265,8 @@ export default function Dashboard(): React.JSX.Element {
         </Card>
       </div>
 
+      <HistoryChart tunnels={tunnels.map((t) => t.id)} />
+
       <Card>
         <CardHeader>
           <CardTitle>Tunnels</CardTitle>
@@ -304,6 +308,14 @@ export default function Dashboard(): React.JSX.Element {
                     <TableRow key={tunnel.id} className="h-12">
                       <TableCell className="py-1 font-medium font-mono text-xs">
                         {tunnel.id}
+                        {tunnel.owner && (
+                          <div
+                            className="max-w-40 truncate text-[10px] text-muted-foreground"
+                            title={tunnel.owner}
+                          >
+                            {tunnel.owner}
+                          </div>
+                        )}
                       </TableCell>
                       <TableCell className="py-1 text-xs">
                         <a
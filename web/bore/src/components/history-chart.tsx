@@ -0,0 +1,221 @@
+import { useEffect, useState } from "react";
+import { cn } from "@/lib/utils";
+import {
+  Card,
+  CardContent,
+  CardDescription,
+  CardHeader,
+  CardTitle,
+} from "./ui/card";
+
+interface HistoryPoint {
+  time: number;
+  bytesIn: number;
+  bytesOut: number;
+}
+
+interface HistoryResponse {
+  tunnel?: string;
+  step: number;
+  points: HistoryPoint[];
+}
+
+const ranges = [
+  { label: "1h", seconds: 3600, step: "1m" },
+  { label: "24h", seconds: 86400, step: "15m" },
+  { label: "7d", seconds: 7 * 86400, step: "2h" },
+  { label: "30d", seconds: 30 * 86400, step: "6h" },
+];
+
+const width = 800;
+const height = 200;
+
+function formatTotalBytes(bytes: number): string {
+  if (bytes === 0) return "0 B";
+  const k = 1024;
+  const sizes = ["B", "KB", "MB", "GB", "TB"];
+  const i = Math.floor(Math.log(bytes) / Math.log(k));
+  return `${(bytes / k ** i).toFixed(2)} ${sizes[i]}`;
+}
+
+function formatTime(time: number, rangeSeconds: number): string {
+  const date = new Date(time * 1000);
+  if (rangeSeconds <= 86400) {
+    return date.toLocaleTimeString([], {
+      hour: "2-digit",
+      minute: "2-digit",
+    });
+  }
+  return date.toLocaleDateString([], { month: "short", day: "numeric" });
+}
+
+function linePath(
+  points: HistoryPoint[],
+  max: number,
+  key: "bytesIn" | "bytesOut",
+): string {
+  if (points.length === 0) return "";
+  const dx = points.length > 1 ? width / (points.length - 1) : 0;
+  return points
+    .map((p, i) => {
+      const x = i * dx;
+      const y = height - (p[key] / max) * height;
+      return `${i === 0 ? "M" : "L"}${x.toFixed(1)},${y.toFixed(1)}`;
+    })
+    .join(" ");
+}
+
+export default function HistoryChart({
+  tunnels,
+}: {
+  tunnels: string[];
+}): React.JSX.Element {
+  const [range, setRange] = useState(ranges[0]);
+  const [tunnel, setTunnel] = useState("");
+  const [history, setHistory] = useState<HistoryResponse | null>(null);
+  const [error, setError] = useState<string | null>(null);
+
+  useEffect(() => {
+    let cancelled = false;
+
+    const load = async () => {
+      const to = Math.floor(Date.now() / 1000);
+      const params = new URLSearchParams({
+        from: String(to - range.seconds),
+        to: String(to),
+        step: range.step,
+      });
+      if (tunnel) params.set("tunnel", tunnel);
+
+      try {
+        const res = await fetch(`/api/metrics/history?${params}`);
+        const data = await res.json();
+        if (cancelled) return;
+        if (!res.ok) {
+          setError(data.error || "Failed to load history");
+          return;
+        }
+        setHistory(data);
+        setError(null);
+      } catch (_err) {
+        if (!cancelled) setError("Failed to load history");
+      }
+    };
+
+    load();
+    const interval = setInterval(load, 60000);
+
+    return () => {
+      cancelled = true;
+      clearInterval(interval);
+    };
+  }, [range, tunnel]);
+
+  const points = history?.points || [];
+  const max = Math.max(
+    1,
+    ...points.map((p) => Math.max(p.bytesIn, p.bytesOut)),
+  );
+  const totalIn = points.reduce((sum, p) => sum + p.bytesIn, 0);
+  const totalOut = points.reduce((sum, p) => sum + p.bytesOut, 0);
+
+  return (
+    <Card>
+      <CardHeader className="flex flex-row items-start justify-between space-y-0">
+        <div className="space-y-1.5">
+          <CardTitle>Traffic History</CardTitle>
+          <CardDescription>
+            {formatTotalBytes(totalIn)} in, {formatTotalBytes(totalOut)} out
+            over the last {range.label}
+          </CardDescription>
+        </div>
+        <div className="flex items-center gap-2">
+          <select
+            value={tunnel}
+            onChange={(e) => setTunnel(e.target.value)}
+            className="h-8 rounded-md border border-input bg-background px-2 text-xs"
+            aria-label="Tunnel"
+          >
+            <option value="">All tunnels</option>
+            {tunnel && !tunnels.includes(tunnel) && (
+              <option value={tunnel}>{tunnel}</option>
+            )}
+            {tunnels.map((id) => (
+              <option key={id} value={id}>
+                {id}
+              </option>
+            ))}
+          </select>
+          <div className="inline-flex rounded-md border border-input">
+            {ranges.map((r) => (
+              <button
+                key={r.label}
+                type="button"
+                onClick={() => setRange(r)}
+                className={cn(
+                  "h-8 px-2.5 text-xs hover:bg-accent hover:text-accent-foreground",
+                  r.label === range.label && "bg-accent text-accent-foreground",
+                )}
+              >
+                {r.label}
+              </button>
+            ))}
+          </div>
+        </div>
+      </CardHeader>
+      <CardContent>
+        {error ? (
+          <div className="py-10 text-center text-muted-foreground text-sm">
+            {error}
+          </div>
+        ) : (
+          <div className="space-y-2">
+            <div className="relative">
+              <span className="absolute top-0 left-0 text-[10px] text-muted-foreground">
+                {formatTotalBytes(max)}
+              </span>
+              <svg
+                viewBox={`0 0 ${width} ${height}`}
+                preserveAspectRatio="none"
+                className="h-48 w-full"
+              >
+                <path
+                  d={linePath(points, max, "bytesIn")}
+                  fill="none"
+                  vectorEffect="non-scaling-stroke"
+                  className="stroke-2 stroke-blue-500"
+                />
+                <path
+                  d={linePath(points, max, "bytesOut")}
+                  fill="none"
+                  vectorEffect="non-scaling-stroke"
+                  className="stroke-2 stroke-green-500"
+                />
+              </svg>
+            </div>
+            <div className="flex items-center justify-between text-[10px] text-muted-foreground">
+              <span>
+                {points.length > 0 &&
+                  formatTime(points[0].time, range.seconds)}
+              </span>
+              <span className="flex gap-3">
+                <span className="flex items-center gap-1">
+                  <span className="h-2 w-2 rounded-full bg-blue-500" />
+                  In
+                </span>
+                <span className="flex items-center gap-1">
+                  <span className="h-2 w-2 rounded-full bg-green-500" />
+                  Out
+                </span>
+              </span>
+              <span>
+                {points.length > 0 &&
+                  formatTime(points[points.length - 1].time, range.seconds)}
+              </span>
+            </div>
+          </div>
+        )}
+      </CardContent>
+    </Card>
+  );
+}